@@ -0,0 +1,296 @@
+package autoproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type Action int
+
+const (
+	Direct Action = iota
+	Proxy
+	Block
+)
+
+func (a Action) String() string {
+	switch a {
+	case Direct:
+		return "DIRECT"
+	case Proxy:
+		return "PROXY"
+	case Block:
+		return "BLOCK"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// Rule is a single AutoProxy rule. Domain is set for "||domain" rules, which
+// match the domain and all of its subdomains, otherwise Pattern holds a
+// regexp matched against the full url. Keyword rules without an anchor only
+// match http urls, as in AutoProxy.
+type Rule struct {
+	Raw       string
+	Exception bool
+	Domain    string
+	Pattern   string
+	re        *regexp.Regexp
+}
+
+func (r *Rule) match(host, rawurl string) bool {
+	if r.Domain != "" {
+		return host == r.Domain || strings.HasSuffix(host, "."+r.Domain)
+	}
+	return r.re.MatchString(rawurl)
+}
+
+// RuleList is a parsed AutoProxy/Adblock Plus list. Urls matching a rule
+// get Action, urls matching an "@@" exception get Direct.
+type RuleList struct {
+	Action     Action
+	Rules      []*Rule
+	domains    map[string]struct{}
+	excDomains map[string]struct{}
+	rules      []*Rule
+	excRules   []*Rule
+}
+
+// ParseRule parses one line of an AutoProxy list. It returns nil for
+// comments, headers and blank lines.
+func ParseRule(line string) (*Rule, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '!' || line[0] == '[' {
+		return nil, nil
+	}
+
+	r := &Rule{Raw: line}
+	if strings.HasPrefix(line, "@@") {
+		r.Exception = true
+		line = line[2:]
+	}
+
+	// regexp rule
+	if len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/' {
+		r.Pattern = line[1 : len(line)-1]
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("autoproxy: invalid rule %#v: %s", r.Raw, err)
+		}
+		r.re = re
+		return r, nil
+	}
+
+	// strip adblock options
+	if i := strings.LastIndex(line, "$"); i >= 0 {
+		line = line[:i]
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	var prefix, suffix string
+	switch {
+	case strings.HasPrefix(line, "||"):
+		line = line[2:]
+		if !strings.ContainsAny(line, "/*^|") {
+			r.Domain = strings.ToLower(strings.TrimSuffix(line, "."))
+			return r, nil
+		}
+		prefix = `^[\w\-]+:/+(?:[^/]+\.)?`
+	case strings.HasPrefix(line, "|"):
+		line = line[1:]
+		prefix = "^"
+	default:
+		// keyword rules only apply to plain http urls
+		prefix = "^http://.*"
+	}
+	if strings.HasSuffix(line, "|") {
+		line = line[:len(line)-1]
+		suffix = "$"
+	}
+
+	var b bytes.Buffer
+	b.WriteString(prefix)
+	for _, c := range line {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '^':
+			b.WriteString(`(?:[^\w\-.%]|$)`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString(suffix)
+	r.Pattern = b.String()
+
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("autoproxy: invalid rule %#v: %s", r.Raw, err)
+	}
+	r.re = re
+	return r, nil
+}
+
+// decodeList returns the plain text of a list which may be base64 wrapped,
+// as gfwlist.txt is.
+func decodeList(data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] == '[' || data[0] == '!' {
+		return data
+	}
+	s := strings.Map(func(r rune) rune {
+		switch r {
+		case '\r', '\n', ' ', '\t':
+			return -1
+		}
+		return r
+	}, string(data))
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b
+	}
+	return data
+}
+
+// Parse reads an AutoProxy list from r. Matching urls get action.
+func Parse(r io.Reader, action Action) (*RuleList, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &RuleList{
+		Action:     action,
+		Rules:      make([]*Rule, 0),
+		domains:    make(map[string]struct{}),
+		excDomains: make(map[string]struct{}),
+		rules:      make([]*Rule, 0),
+		excRules:   make([]*Rule, 0),
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(decodeList(data)))
+	for scanner.Scan() {
+		rule, err := ParseRule(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		if rule == nil {
+			continue
+		}
+		l.Add(rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ParseFile reads an AutoProxy list from filename.
+func ParseFile(filename string, action Action) (*RuleList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f, action)
+}
+
+// Add appends rule to the list.
+func (l *RuleList) Add(rule *Rule) {
+	l.Rules = append(l.Rules, rule)
+	switch {
+	case rule.Exception && rule.Domain != "":
+		l.excDomains[rule.Domain] = struct{}{}
+	case rule.Exception:
+		l.excRules = append(l.excRules, rule)
+	case rule.Domain != "":
+		l.domains[rule.Domain] = struct{}{}
+	default:
+		l.rules = append(l.rules, rule)
+	}
+}
+
+func matchDomains(domains map[string]struct{}, host string) bool {
+	for {
+		if _, ok := domains[host]; ok {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+func matchRules(rules []*Rule, host, rawurl string) bool {
+	for _, r := range rules {
+		if r.match(host, rawurl) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether the url matches the list. ok is false when neither a
+// rule nor an exception matches.
+func (l *RuleList) Match(u *url.URL) (action Action, ok bool) {
+	host := hostname(u.Host)
+	rawurl := u.String()
+	if matchDomains(l.excDomains, host) || matchRules(l.excRules, host, rawurl) {
+		return Direct, true
+	}
+	if matchDomains(l.domains, host) || matchRules(l.rules, host, rawurl) {
+		return l.Action, true
+	}
+	return Direct, false
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// Matcher consults Lists in order, the first list having an opinion about a
+// url wins, otherwise Default is returned.
+type Matcher struct {
+	Lists   []*RuleList
+	Default Action
+}
+
+func NewMatcher(lists ...*RuleList) *Matcher {
+	return &Matcher{
+		Lists:   lists,
+		Default: Direct,
+	}
+}
+
+func (m *Matcher) MatchURL(u *url.URL) Action {
+	for _, l := range m.Lists {
+		if action, ok := l.Match(u); ok {
+			return action
+		}
+	}
+	return m.Default
+}
+
+// MatchRequest matches a proxy request. CONNECT requests are matched as
+// "https://host/" since the path is not visible to the proxy.
+func (m *Matcher) MatchRequest(req *http.Request) Action {
+	if req.Method == "CONNECT" {
+		return m.MatchURL(&url.URL{Scheme: "https", Host: hostname(req.Host), Path: "/"})
+	}
+	return m.MatchURL(req.URL)
+}
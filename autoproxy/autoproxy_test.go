@@ -0,0 +1,82 @@
+package autoproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const gfwlist = `[AutoProxy 0.2.9]
+! Checksum: ignored
+! comment line
+||google.com
+||twimg.com^
+|http://85.17.73.31/
+|https://www.example.org/secret
+.wikipedia.org
+keyword
+@@||mail.google.com
+@@|http://www.example.net/ok
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+`
+
+func TestParseAndMatch(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(gfwlist))
+	var wrapped []string
+	for len(encoded) > 64 {
+		wrapped = append(wrapped, encoded[:64])
+		encoded = encoded[64:]
+	}
+	wrapped = append(wrapped, encoded)
+
+	for _, data := range []string{gfwlist, strings.Join(wrapped, "\n")} {
+		l, err := Parse(strings.NewReader(data), Proxy)
+		if err != nil {
+			t.Fatalf("Parse error: %s", err)
+		}
+		if len(l.Rules) != 9 {
+			t.Errorf("len(Rules) = %d, want 9", len(l.Rules))
+		}
+
+		adblock, err := Parse(strings.NewReader("||ads.example.com^$third-party\n"), Block)
+		if err != nil {
+			t.Fatalf("Parse error: %s", err)
+		}
+
+		m := NewMatcher(l, adblock)
+		tests := []struct {
+			url    string
+			action Action
+		}{
+			{"http://www.google.com/", Proxy},
+			{"https://google.com:443/search", Proxy},
+			{"https://mail.google.com/", Direct},
+			{"http://pbs.twimg.com/a.jpg", Proxy},
+			{"http://85.17.73.31/index.html", Proxy},
+			{"http://www.85.17.73.31/", Direct},
+			{"https://www.example.org/secret/1", Proxy},
+			{"http://www.example.org/secret/1", Direct},
+			{"http://en.wikipedia.org/wiki/Go", Proxy},
+			{"https://en.wikipedia.org/wiki/Go", Direct},
+			{"http://www.example.net/keyword", Proxy},
+			{"http://www.example.net/ok/keyword", Direct},
+			{"https://foo.blogspot.com/", Proxy},
+			{"http://ads.example.com/banner.gif", Block},
+			{"http://golang.org/", Direct},
+		}
+		for _, test := range tests {
+			u, _ := url.Parse(test.url)
+			if action := m.MatchURL(u); action != test.action {
+				t.Errorf("MatchURL(%#v) = %s, want %s", test.url, action, test.action)
+			}
+		}
+
+		req, _ := http.NewRequest("CONNECT", "", nil)
+		req.Host = "www.google.com:443"
+		if action := m.MatchRequest(req); action != Proxy {
+			t.Errorf("MatchRequest(CONNECT %s) = %s, want %s", req.Host, action, Proxy)
+		}
+	}
+}
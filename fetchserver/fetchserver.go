@@ -0,0 +1,325 @@
+// Copyright 2012 Phus Lu. All rights reserved.
+
+// Package fetchserver serves the /_gh/ protocol of the gae filter, with the
+// fetching left to the platform: urlfetch on appengine, http.Transport on a
+// vps.
+package fetchserver
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Version = "1.0"
+
+	// ProtocolVersion is sent as X-Fetch-Version, clients send enveloped
+	// requests to fetchservers from version 2.
+	ProtocolVersion = "2"
+
+	FetchMaxSize = 1024 * 1024 * 4
+	Deadline     = 30 * time.Second
+	// FetchMax is the count of fetches tried for a request, clients may ask
+	// for up to MaxFetchMax.
+	FetchMax    = 2
+	MaxFetchMax = 5
+
+	SignatureExpires = 5 * time.Minute
+)
+
+// Logger is satisfied by appengine.Context.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Handler decodes the requests sent by the gae filter, fetches them with
+// Transport and encodes the responses back.
+type Handler struct {
+	Password string
+	// Transport returns the RoundTripper fetching the request carried by r.
+	Transport func(r *http.Request, deadline time.Duration, validate bool) http.RoundTripper
+	// AddNonce records the nonce of a signed request until expiration, it
+	// returns false if the nonce is recorded already. Replays are not
+	// detected if it is nil.
+	AddNonce func(r *http.Request, nonce string, expiration time.Duration) (bool, error)
+	// Logger returns the logger of r.
+	Logger func(r *http.Request) Logger
+}
+
+func Favicon(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func Robots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "User-agent: *\nDisallow: /\n")
+}
+
+func handlerError(w io.Writer, html string, code int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d\r\n", code)
+	fmt.Fprintf(w, "Content-Type: text/html; charset=utf-8\r\n")
+	fmt.Fprintf(w, "Content-Length: %d\r\n", len(html))
+	io.WriteString(w, "\r\n")
+	io.WriteString(w, html)
+}
+
+// Signature is the hex HMAC-SHA256 of method, url, timestamp and nonce keyed
+// with the password, as sent by the gae filter of the client.
+func Signature(password, method, rawurl, timestamp, nonce string) string {
+	h := hmac.New(sha256.New, []byte(password))
+	for _, s := range []string{method, rawurl, timestamp, nonce} {
+		h.Write([]byte(s))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkSignature rejects requests with a wrong signature, a timestamp out of
+// SignatureExpires, or a nonce seen before.
+func (h *Handler) checkSignature(logger Logger, r *http.Request, req *http.Request, params map[string]string) error {
+	timestamp, nonce, sig := params["timestamp"], params["nonce"], params["signature"]
+	if timestamp == "" || nonce == "" || sig == "" {
+		return fmt.Errorf("Missing Signature.")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid Timestamp.")
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > SignatureExpires || d < -SignatureExpires {
+		return fmt.Errorf("Stale Signature.")
+	}
+	if !hmac.Equal([]byte(sig), []byte(Signature(h.Password, req.Method, req.RequestURI, timestamp, nonce))) {
+		return fmt.Errorf("Wrong Signature.")
+	}
+	if h.AddNonce != nil {
+		if ok, err := h.AddNonce(r, nonce, 2*SignatureExpires); err != nil {
+			logger.Warningf("AddNonce(%#v) return %#v", nonce, err)
+		} else if !ok {
+			return fmt.Errorf("Replayed Signature.")
+		}
+	}
+	return nil
+}
+
+// NonceCache remembers nonces in memory, for fetchservers without memcache.
+type NonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	next   time.Time
+}
+
+// Add records nonce until expiration, it returns false if nonce is recorded
+// already.
+func (c *NonceCache) Add(nonce string, expiration time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.nonces == nil {
+		c.nonces = make(map[string]time.Time)
+	}
+	if now.After(c.next) {
+		for key, until := range c.nonces {
+			if now.After(until) {
+				delete(c.nonces, key)
+			}
+		}
+		c.next = now.Add(expiration)
+	}
+	if until, ok := c.nonces[nonce]; ok && now.Before(until) {
+		return false
+	}
+	c.nonces[nonce] = now.Add(expiration)
+	return true
+}
+
+// decodeRequest reads the request carried by the body of r, and the X-Fetch-*
+// params of r.
+func (h *Handler) decodeRequest(r *http.Request) (*http.Request, map[string]string, error) {
+	var err error
+	var rc io.Reader = r.Body
+	if r.Header.Get("X-Fetch-Version") != "" {
+		rc = NewEnvelopeReader(rc, h.Password)
+	}
+	if strings.HasSuffix(r.URL.Path, "/gzip") {
+		rc, err = gzip.NewReader(rc)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(rc))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	params := make(map[string]string, 2)
+	paramPrefix := "X-Fetch-"
+	for key, values := range r.Header {
+		if strings.HasPrefix(key, paramPrefix) {
+			params[strings.ToLower(key[len(paramPrefix):])] = values[0]
+		}
+	}
+	for key := range params {
+		req.Header.Del(paramPrefix + key)
+	}
+	return req, params, nil
+}
+
+const (
+	errorUnknown = iota
+	errorFetch
+	errorDeadline
+	errorInvalidURL
+	errorTooLarge
+)
+
+// classifyError tells how to retry a failed fetch, from the messages of
+// urlfetch or the errors of http.Transport.
+func classifyError(err error) int {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return errorDeadline
+	}
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "FETCH_ERROR"):
+		return errorFetch
+	case strings.Contains(message, "DEADLINE_EXCEEDED"):
+		return errorDeadline
+	case strings.Contains(message, "INVALID_URL"), strings.Contains(message, "unsupported protocol scheme"):
+		return errorInvalidURL
+	case strings.Contains(message, "RESPONSE_TOO_LARGE"):
+		return errorTooLarge
+	}
+	if _, ok := err.(net.Error); ok {
+		return errorFetch
+	}
+	return errorUnknown
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.Logger(r)
+	logger.Infof("Handle Request %#v\n", r)
+	w.Header().Set("X-Fetch-Version", ProtocolVersion)
+
+	req, params, err := h.decodeRequest(r)
+	if err != nil {
+		logger.Errorf("decodeRequest(%#v) return %#v", r.URL.String(), err)
+		handlerError(w, "Invalid Request.", 400)
+		return
+	}
+
+	// the response of an enveloped request is enveloped too
+	var out io.Writer = w
+	if r.Header.Get("X-Fetch-Version") != "" {
+		ew := NewEnvelopeWriter(w, h.Password)
+		defer ew.Close()
+		out = ew
+	}
+
+	if h.Password != "" {
+		if err := h.checkSignature(logger, r, req, params); err != nil {
+			logger.Warningf("checkSignature(%#v) return %v", req.URL.String(), err)
+			handlerError(out, err.Error(), 403)
+			return
+		}
+	}
+
+	deadline := Deadline
+	if n, err := strconv.Atoi(params["deadline"]); err == nil && n > 0 {
+		deadline = time.Duration(n) * time.Second
+	}
+	validate := params["validate"] == "1"
+	maxsize := FetchMaxSize
+	if n, err := strconv.Atoi(params["maxsize"]); err == nil && n > 0 {
+		maxsize = n
+	}
+	fetchmax := FetchMax
+	if n, err := strconv.Atoi(params["fetchmax"]); err == nil && n > 0 {
+		fetchmax = n
+		if fetchmax > MaxFetchMax {
+			fetchmax = MaxFetchMax
+		}
+	}
+
+	var errors []error
+	var resp *http.Response
+	for i := 0; i < fetchmax; i++ {
+		resp, err = h.Transport(r, deadline, validate).RoundTrip(req)
+		if err == nil {
+			break
+		}
+		errors = append(errors, err)
+		switch classifyError(err) {
+		case errorFetch:
+			logger.Warningf("URLFetchServiceError_FETCH_ERROR(type=%T, deadline=%v, url=%v)", err, deadline, req.URL)
+			time.Sleep(time.Second)
+			deadline *= 2
+		case errorDeadline:
+			logger.Warningf("URLFetchServiceError_DEADLINE_EXCEEDED(type=%T, deadline=%v, url=%v)", err, deadline, req.URL)
+			time.Sleep(time.Second)
+			deadline *= 2
+		case errorInvalidURL:
+			handlerError(out, fmt.Sprintf("Invalid URL: %v", err), 501)
+			return
+		case errorTooLarge:
+			logger.Warningf("URLFetchServiceError_RESPONSE_TOO_LARGE(type=%T, deadline=%v, url=%v)", err, deadline, req.URL)
+			req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", maxsize))
+			deadline *= 2
+		default:
+			logger.Warningf("URLFetchServiceError UNKOWN(type=%T, deadline=%v, url=%v, error=%v)", err, deadline, req.URL, err)
+			time.Sleep(4 * time.Second)
+		}
+	}
+
+	if len(errors) == fetchmax {
+		// the outer status tells the client to try another appid, an
+		// inner 502 may come from the origin
+		w.WriteHeader(http.StatusBadGateway)
+		handlerError(out, fmt.Sprintf("Go Server Fetch Failed: %v", errors), 502)
+		return
+	}
+	defer resp.Body.Close()
+
+	writeResponse(w, out, resp)
+}
+
+// writeResponse writes resp to out, gzipped if it is small enough.
+func writeResponse(w http.ResponseWriter, out io.Writer, resp *http.Response) {
+	w.Header().Set("Content-Type", "image/gif")
+	if resp.ContentLength >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	var w1 io.Writer
+	if resp.TransferEncoding == nil && resp.ContentLength <= 1024*1024 {
+		w.Header().Set("X-Content-Encoding", "gzip")
+		gw := gzip.NewWriter(out)
+		defer gw.Close()
+		w1 = gw
+	} else {
+		w1 = out
+	}
+
+	fmt.Fprintf(w1, "%s %s\r\n", resp.Proto, resp.Status)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			fmt.Fprintf(w1, "%s: %s\r\n", key, value)
+		}
+	}
+	io.WriteString(w1, "\r\n")
+	io.Copy(w1, resp.Body)
+}
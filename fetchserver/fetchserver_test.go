@@ -0,0 +1,47 @@
+package fetchserver
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	for _, test := range []struct {
+		err   error
+		class int
+	}{
+		{errors.New("API error 2 (urlfetch: FETCH_ERROR)"), errorFetch},
+		{errors.New("API error 5 (urlfetch: DEADLINE_EXCEEDED)"), errorDeadline},
+		{errors.New("API error 1 (urlfetch: INVALID_URL)"), errorInvalidURL},
+		{errors.New("API error 4 (urlfetch: RESPONSE_TOO_LARGE)"), errorTooLarge},
+		{errors.New("unsupported protocol scheme \"ftp\""), errorInvalidURL},
+		{timeoutError{}, errorDeadline},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, errorFetch},
+		{errors.New("something else"), errorUnknown},
+	} {
+		if class := classifyError(test.err); class != test.class {
+			t.Errorf("classifyError(%#v) = %d, want %d", test.err.Error(), class, test.class)
+		}
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := &NonceCache{}
+	if !c.Add("a", time.Minute) {
+		t.Errorf("Add(a) = false, want true")
+	}
+	if c.Add("a", time.Minute) {
+		t.Errorf("Add(a) again = true, want false")
+	}
+	if !c.Add("b", -time.Second) || !c.Add("b", time.Minute) {
+		t.Errorf("Add(b) after expiration = false, want true")
+	}
+}
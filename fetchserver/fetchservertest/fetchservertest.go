@@ -0,0 +1,201 @@
+// Package fetchservertest runs a fetchserver in process, for tests of the gae
+// filter with no network.
+package fetchservertest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/phuslu/goproxy/fetchserver"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Fault makes the fetchserver of an appid fail like appengine does.
+type Fault int
+
+const (
+	// NoFault serves requests normally.
+	NoFault Fault = iota
+	// OverQuota answers 503 to every request.
+	OverQuota
+	// DeadlineExceeded fails every fetch with DEADLINE_EXCEEDED.
+	DeadlineExceeded
+	// ResponseTooLarge fails the fetches without a Range header with
+	// RESPONSE_TOO_LARGE, so that the fetchserver falls back to a range.
+	ResponseTooLarge
+	// WrongPassword serves requests with a password the client does not
+	// know.
+	WrongPassword
+)
+
+var (
+	errDeadlineExceeded = errors.New("API error 5 (urlfetch: DEADLINE_EXCEEDED)")
+	errResponseTooLarge = errors.New("API error 4 (urlfetch: RESPONSE_TOO_LARGE)")
+)
+
+// Server serves /_gh/ and /_gh/gzip for any appid, fetching the requests from
+// Origin instead of the network.
+type Server struct {
+	*httptest.Server
+	Origin http.Handler
+
+	handler      *fetchserver.Handler
+	wrongHandler *fetchserver.Handler
+
+	mu     sync.Mutex
+	faults map[string]Fault
+	hits   map[string]int
+}
+
+// NewServer starts a fetchserver with password which fetches from origin.
+func NewServer(origin http.Handler, password string) *Server {
+	s := &Server{
+		Origin: origin,
+		faults: make(map[string]Fault),
+		hits:   make(map[string]int),
+	}
+	nonces := &fetchserver.NonceCache{}
+	s.handler = &fetchserver.Handler{
+		Password:  password,
+		Transport: s.transport,
+		AddNonce: func(r *http.Request, nonce string, expiration time.Duration) (bool, error) {
+			return nonces.Add(nonce, expiration), nil
+		},
+		Logger: func(r *http.Request) fetchserver.Logger {
+			return nopLogger{}
+		},
+	}
+	wrongHandler := *s.handler
+	wrongHandler.Password = password + "-wrong"
+	s.wrongHandler = &wrongHandler
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_gh/", s.serve)
+	mux.HandleFunc("/_gh/gzip", s.serve)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetFault injects fault into the fetchserver of appid, or of all the appids
+// without a fault of their own if appid is "".
+func (s *Server) SetFault(appid string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[appid] = fault
+}
+
+// Hits returns the count of requests sent to appid.
+func (s *Server) Hits(appid string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[appid]
+}
+
+// Dial connects the server whatever addr is, so that a transport using it
+// reaches the server for every appid.
+func (s *Server) Dial(network, addr string) (net.Conn, error) {
+	return net.Dial("tcp", s.Listener.Addr().String())
+}
+
+// Transport returns a transport for gae.Filter, with the filter in "http"
+// mode.
+func (s *Server) Transport() *http.Transport {
+	return &http.Transport{
+		Dial:               s.Dial,
+		DisableCompression: true,
+	}
+}
+
+func appID(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		return host[:i]
+	}
+	return host
+}
+
+func (s *Server) fault(appid string) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if fault, ok := s.faults[appid]; ok {
+		return fault
+	}
+	return s.faults[""]
+}
+
+func (s *Server) serve(rw http.ResponseWriter, r *http.Request) {
+	appid := appID(r.Host)
+	s.mu.Lock()
+	s.hits[appid]++
+	s.mu.Unlock()
+
+	switch s.fault(appid) {
+	case OverQuota:
+		http.Error(rw, "Over Quota", http.StatusServiceUnavailable)
+	case WrongPassword:
+		s.wrongHandler.ServeHTTP(rw, r)
+	default:
+		s.handler.ServeHTTP(rw, r)
+	}
+}
+
+// transport returns the urlfetch of appid, which serves requests with Origin.
+func (s *Server) transport(r *http.Request, deadline time.Duration, validate bool) http.RoundTripper {
+	return &originTransport{s, s.fault(appID(r.Host))}
+}
+
+type originTransport struct {
+	s     *Server
+	fault Fault
+}
+
+func (t *originTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case t.fault == DeadlineExceeded:
+		return nil, errDeadlineExceeded
+	case t.fault == ResponseTooLarge && req.Header.Get("Range") == "":
+		return nil, errResponseTooLarge
+	}
+
+	rec := httptest.NewRecorder()
+	t.s.Origin.ServeHTTP(rec, req)
+	resp := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		StatusCode: rec.Code,
+		Status:     fmt.Sprintf("%d %s", rec.Code, http.StatusText(rec.Code)),
+		Header:     rec.HeaderMap,
+		Request:    req,
+	}
+	body := rec.Body.Bytes()
+
+	// urlfetch honors Range for origins which do not
+	var start, end int
+	if n, _ := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end); n == 2 && rec.Code == http.StatusOK && start < len(body) {
+		if end >= len(body) {
+			end = len(body) - 1
+		}
+		resp.StatusCode = http.StatusPartialContent
+		resp.Status = "206 Partial Content"
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+		body = body[start : end+1]
+	}
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(format string, args ...interface{})    {}
+func (nopLogger) Warningf(format string, args ...interface{}) {}
+func (nopLogger) Errorf(format string, args ...interface{})   {}
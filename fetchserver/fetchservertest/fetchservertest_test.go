@@ -0,0 +1,138 @@
+package fetchservertest
+
+import (
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"github.com/phuslu/goproxy/httpproxy/filters/gae"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var content = strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz", 3)
+
+func newServer() *Server {
+	return NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			b, _ := ioutil.ReadAll(r.Body)
+			io.WriteString(rw, r.Method+" "+r.Header.Get("X-Test")+" "+string(b))
+		default:
+			io.WriteString(rw, content)
+		}
+	}), "secret")
+}
+
+func newFilter(s *Server, appids ...string) *gae.Filter {
+	f0, _ := gae.NewFilter()
+	f := f0.(*gae.Filter)
+	f.AppIDs = appids
+	f.Scheme = "http"
+	f.Password = "secret"
+	f.Transport = s.Transport()
+	return f
+}
+
+func get(t *testing.T, f *gae.Filter, req *http.Request) (*http.Response, string) {
+	_, resp, err := f.RoundTrip(&filters.Context{}, req)
+	if err != nil {
+		t.Fatalf("RoundTrip(%#v) error: %s", req.URL.String(), err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll error: %s", err)
+	}
+	return resp, string(b)
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	for _, obfuscate := range []bool{false, true} {
+		f := newFilter(s, "a")
+		f.Obfuscate = obfuscate
+		req, _ := http.NewRequest("POST", "http://www.example.com/echo", strings.NewReader("a=b"))
+		req.Header.Set("X-Test", "ok")
+		resp, body := get(t, f, req)
+		if want := "POST ok a=b"; resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("obfuscate=%v: response = %d %q, want 200 %q", obfuscate, resp.StatusCode, body, want)
+		}
+	}
+}
+
+func TestOverQuota(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.SetFault("a", OverQuota)
+
+	f := newFilter(s, "a", "b")
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		if resp, body := get(t, f, req); resp.StatusCode != http.StatusOK || body != content {
+			t.Errorf("response = %d %q, want 200 %q", resp.StatusCode, body, content)
+		}
+	}
+	// the over quota appid is skipped after its first failure
+	if s.Hits("a") != 1 || s.Hits("b") != 2 {
+		t.Errorf("hits = %d, %d, want 1, 2", s.Hits("a"), s.Hits("b"))
+	}
+}
+
+func TestDeadlineExceeded(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.SetFault("a", DeadlineExceeded)
+
+	// the fetchserver of a gives up after a retry, and b is tried
+	f := newFilter(s, "a", "b")
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	if resp, body := get(t, f, req); resp.StatusCode != http.StatusOK || body != content {
+		t.Errorf("response = %d %q, want 200 %q", resp.StatusCode, body, content)
+	}
+	if s.Hits("a") != 1 || s.Hits("b") != 1 {
+		t.Errorf("hits = %d, %d, want 1, 1", s.Hits("a"), s.Hits("b"))
+	}
+
+	// a is blacklisted
+	req, _ = http.NewRequest("GET", "http://www.example.com/", nil)
+	get(t, f, req)
+	if s.Hits("a") != 1 || s.Hits("b") != 2 {
+		t.Errorf("hits = %d, %d, want 1, 2", s.Hits("a"), s.Hits("b"))
+	}
+
+	s.SetFault("b", DeadlineExceeded)
+	req, _ = http.NewRequest("GET", "http://www.example.com/", nil)
+	if _, resp, err := f.RoundTrip(&filters.Context{}, req); err == nil {
+		resp.Body.Close()
+		t.Errorf("RoundTrip succeeded with all appids failing")
+	}
+}
+
+func TestResponseTooLarge(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.SetFault("", ResponseTooLarge)
+
+	f := newFilter(s, "a", "b")
+	f.MaxSize = 9
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	resp, body := get(t, f, req)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(content)) || body != content {
+		t.Errorf("response = %d, Content-Length %d, %q, want 200 %q", resp.StatusCode, resp.ContentLength, body, content)
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.SetFault("a", WrongPassword)
+
+	f := newFilter(s, "a")
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	if resp, _ := get(t, f, req); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("response = %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,109 @@
+package fetchserver_test
+
+import (
+	"github.com/phuslu/goproxy/fetchserver"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"github.com/phuslu/goproxy/httpproxy/filters/gae"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Infof(format string, args ...interface{})    {}
+func (l testLogger) Warningf(format string, args ...interface{}) { l.t.Logf(format, args...) }
+func (l testLogger) Errorf(format string, args ...interface{})   { l.t.Logf(format, args...) }
+
+// TestGAEFilter runs the gae filter of the client against a Handler which
+// fetches with http.Transport.
+func TestGAEFilter(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			rw.Header().Set("Content-Length", "2097152")
+			io.WriteString(rw, strings.Repeat("x", 2097152))
+			return
+		}
+		io.WriteString(rw, "hello "+r.Header.Get("X-Test"))
+	}))
+	defer origin.Close()
+
+	nonces := &fetchserver.NonceCache{}
+	server := httptest.NewServer(&fetchserver.Handler{
+		Password: "secret",
+		Transport: func(r *http.Request, deadline time.Duration, validate bool) http.RoundTripper {
+			return &http.Transport{ResponseHeaderTimeout: deadline, DisableCompression: true}
+		},
+		AddNonce: func(r *http.Request, nonce string, expiration time.Duration) (bool, error) {
+			return nonces.Add(nonce, expiration), nil
+		},
+		Logger: func(r *http.Request) fetchserver.Logger {
+			return testLogger{t}
+		},
+	})
+	defer server.Close()
+
+	for _, obfuscate := range []bool{false, true} {
+		f0, _ := gae.NewFilter()
+		f := f0.(*gae.Filter)
+		f.AppIDs = []string{"vps"}
+		f.Scheme = "http"
+		f.Password = "secret"
+		f.Obfuscate = obfuscate
+		f.Transport = &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial(network, server.Listener.Addr().String())
+			},
+		}
+
+		req, _ := http.NewRequest("GET", origin.URL+"/", nil)
+		req.Header.Set("X-Test", "world")
+		_, resp, err := f.RoundTrip(&filters.Context{}, req)
+		if err != nil {
+			t.Fatalf("RoundTrip error: %s", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != "hello world" {
+			t.Errorf("obfuscate=%v: response = %d %q, want 200 %q", obfuscate, resp.StatusCode, b, "hello world")
+		}
+
+		// too large to be gzipped
+		req, _ = http.NewRequest("GET", origin.URL+"/large", nil)
+		_, resp, err = f.RoundTrip(&filters.Context{}, req)
+		if err != nil {
+			t.Fatalf("RoundTrip error: %s", err)
+		}
+		b, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(b) != 2097152 {
+			t.Errorf("obfuscate=%v: response = %d, %d bytes, want 200, 2097152 bytes", obfuscate, resp.StatusCode, len(b))
+		}
+
+		// an envelope sealed with a wrong password cannot be opened at all
+		f.Password = "wrong"
+		req, _ = http.NewRequest("GET", origin.URL+"/", nil)
+		_, resp, err = f.RoundTrip(&filters.Context{}, req)
+		if obfuscate {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("wrong password: RoundTrip error = nil")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("RoundTrip error: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("wrong password: response = %d, want 403", resp.StatusCode)
+		}
+	}
+}
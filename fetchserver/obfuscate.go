@@ -0,0 +1,168 @@
+package fetchserver
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+)
+
+// An envelope is a random salt followed by frames of a 2 bytes length and a
+// ChaCha20-Poly1305 sealed chunk, the last frame seals an empty chunk. The key
+// is derived from the password and the salt, so the nonces are a counter. The
+// gae filter of the client seals its requests with it too.
+
+const (
+	envelopeSaltSize  = 16
+	envelopeChunkSize = 16 * 1024
+)
+
+// ErrEnvelopeTruncated is returned when an envelope ends before its last
+// frame.
+var ErrEnvelopeTruncated = errors.New("truncated envelope")
+
+func newEnvelopeAEAD(password string, salt []byte) (cipher.AEAD, error) {
+	h := hmac.New(sha256.New, []byte(password))
+	h.Write([]byte("goproxy gae envelope"))
+	h.Write(salt)
+	return chacha20poly1305.New(h.Sum(nil))
+}
+
+func incNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// An EnvelopeWriter seals what is written to it in an envelope.
+type EnvelopeWriter struct {
+	w        io.Writer
+	password string
+	aead     cipher.AEAD
+	nonce    []byte
+	buf      []byte
+}
+
+// NewEnvelopeWriter returns a writer which seals to w. The salt is written
+// along with the first frame, Close must be called to write the last frame.
+func NewEnvelopeWriter(w io.Writer, password string) *EnvelopeWriter {
+	return &EnvelopeWriter{w: w, password: password}
+}
+
+func (w *EnvelopeWriter) writeFrame(p []byte) error {
+	var salt []byte
+	if w.aead == nil {
+		salt = make([]byte, envelopeSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		aead, err := newEnvelopeAEAD(w.password, salt)
+		if err != nil {
+			return err
+		}
+		w.aead = aead
+		w.nonce = make([]byte, aead.NonceSize())
+	}
+	w.buf = append(w.buf[:0], salt...)
+	w.buf = append(w.buf, 0, 0)
+	binary.BigEndian.PutUint16(w.buf[len(salt):], uint16(len(p)+w.aead.Overhead()))
+	w.buf = w.aead.Seal(w.buf, w.nonce, p, nil)
+	incNonce(w.nonce)
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+func (w *EnvelopeWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > envelopeChunkSize {
+			chunk = chunk[:envelopeChunkSize]
+		}
+		if err := w.writeFrame(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (w *EnvelopeWriter) Close() error {
+	return w.writeFrame(nil)
+}
+
+// An EnvelopeReader opens an envelope.
+type EnvelopeReader struct {
+	r        io.Reader
+	password string
+	aead     cipher.AEAD
+	nonce    []byte
+	buf      []byte
+	plain    []byte
+	eof      bool
+}
+
+// NewEnvelopeReader returns a reader which opens the envelope read from r.
+func NewEnvelopeReader(r io.Reader, password string) *EnvelopeReader {
+	return &EnvelopeReader{r: r, password: password}
+}
+
+func (r *EnvelopeReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *EnvelopeReader) readFrame() error {
+	if r.aead == nil {
+		salt := make([]byte, envelopeSaltSize)
+		if _, err := io.ReadFull(r.r, salt); err != nil {
+			return ErrEnvelopeTruncated
+		}
+		aead, err := newEnvelopeAEAD(r.password, salt)
+		if err != nil {
+			return err
+		}
+		r.aead = aead
+		r.nonce = make([]byte, aead.NonceSize())
+	}
+	var hdr [2]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return ErrEnvelopeTruncated
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n < r.aead.Overhead() {
+		return ErrEnvelopeTruncated
+	}
+	if cap(r.buf) < n {
+		r.buf = make([]byte, n)
+	}
+	r.buf = r.buf[:n]
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		return ErrEnvelopeTruncated
+	}
+	plain, err := r.aead.Open(r.buf[:0], r.nonce, r.buf, nil)
+	if err != nil {
+		return err
+	}
+	incNonce(r.nonce)
+	r.plain = plain
+	r.eof = len(plain) == 0
+	return nil
+}
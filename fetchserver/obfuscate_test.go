@@ -0,0 +1,32 @@
+package fetchserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+
+	var b bytes.Buffer
+	w := NewEnvelopeWriter(&b, "secret")
+	w.Write(data[:10])
+	w.Write(data[10:])
+	w.Close()
+	if bytes.Contains(b.Bytes(), []byte("0123456789")) {
+		t.Errorf("envelope leaks the plaintext")
+	}
+
+	got, err := ioutil.ReadAll(NewEnvelopeReader(bytes.NewReader(b.Bytes()), "secret"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("envelope read %d bytes, %v, want %d bytes", len(got), err, len(data))
+	}
+
+	if _, err := ioutil.ReadAll(NewEnvelopeReader(bytes.NewReader(b.Bytes()), "wrong")); err == nil {
+		t.Errorf("envelope opened with a wrong password")
+	}
+	if _, err := ioutil.ReadAll(NewEnvelopeReader(bytes.NewReader(b.Bytes()[:b.Len()-18]), "secret")); err != ErrEnvelopeTruncated {
+		t.Errorf("truncated envelope read error = %v, want %v", err, ErrEnvelopeTruncated)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2012 Phus Lu. All rights reserved.
+
+// Command vps serves the /_gh/ protocol of the gae filter on a vps, fetching
+// with http.Transport instead of urlfetch.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/phuslu/goproxy/fetchserver"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type transportKey struct {
+	deadline time.Duration
+	validate bool
+}
+
+// deadlines are the deadlines of the transports, the deadline of a request is
+// rounded up to one of them so that clients cannot make a transport each.
+var deadlines = []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 60 * time.Second, 120 * time.Second}
+
+func roundDeadline(deadline time.Duration) time.Duration {
+	for _, d := range deadlines {
+		if deadline <= d {
+			return d
+		}
+	}
+	return deadlines[len(deadlines)-1]
+}
+
+// transports keeps a transport per deadline and validate, so connections
+// are reused across requests.
+type transports struct {
+	mu sync.Mutex
+	m  map[transportKey]*http.Transport
+}
+
+func (t *transports) get(r *http.Request, deadline time.Duration, validate bool) http.RoundTripper {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deadline = roundDeadline(deadline)
+	key := transportKey{deadline, validate}
+	if tr, ok := t.m[key]; ok {
+		return tr
+	}
+	tr := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   deadline,
+			KeepAlive: 60 * time.Second,
+		}).Dial,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: !validate,
+		},
+		TLSHandshakeTimeout:   deadline,
+		ResponseHeaderTimeout: deadline,
+		DisableCompression:    true,
+		MaxIdleConnsPerHost:   8,
+	}
+	if t.m == nil {
+		t.m = make(map[transportKey]*http.Transport)
+	}
+	t.m[key] = tr
+	return tr
+}
+
+type logger struct{}
+
+func (logger) Infof(format string, args ...interface{})    { glog.Infof(format, args...) }
+func (logger) Warningf(format string, args ...interface{}) { glog.Warningf(format, args...) }
+func (logger) Errorf(format string, args ...interface{})   { glog.Errorf(format, args...) }
+
+func root(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "GoAgent go server %s works on vps\n", fetchserver.Version)
+}
+
+func main() {
+	listen := flag.String("listen", ":8080", "the address to listen on")
+	password := flag.String("password", "", "the password of the clients")
+	certFile := flag.String("certfile", "", "the certificate to serve https")
+	keyFile := flag.String("keyfile", "", "the key of certfile")
+	insecure := flag.Bool("insecure", false, "serve anyone without a password")
+	flag.Set("logtostderr", "true")
+	flag.Parse()
+
+	if *password == "" && !*insecure {
+		glog.Exitln("vps: -password is required, or -insecure to serve anyone as an open proxy")
+	}
+
+	nonces := &fetchserver.NonceCache{}
+	handler := &fetchserver.Handler{
+		Password:  *password,
+		Transport: (&transports{}).get,
+		AddNonce: func(r *http.Request, nonce string, expiration time.Duration) (bool, error) {
+			return nonces.Add(nonce, expiration), nil
+		},
+		Logger: func(r *http.Request) fetchserver.Logger {
+			return logger{}
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/favicon.ico", fetchserver.Favicon)
+	mux.HandleFunc("/robots.txt", fetchserver.Robots)
+	mux.Handle("/_gh/", handler)
+	mux.Handle("/_gh/gzip", handler)
+	mux.HandleFunc("/", root)
+
+	s := &http.Server{
+		Addr:           *listen,
+		Handler:        mux,
+		ReadTimeout:    60 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	glog.Infof("ListenAndServe on %s\n", *listen)
+	if *certFile != "" {
+		glog.Exitln(s.ListenAndServeTLS(*certFile, *keyFile))
+	}
+	glog.Exitln(s.ListenAndServe())
+}
@@ -21,6 +21,7 @@ type CommonConfig struct {
 	ListenPort          int
 	ListenUsername      string
 	ListenPassword      string
+	ListenHtpasswd      string
 	ListenVisible       bool
 	ListenDebuginfo     bool
 	GaeEnable           bool
@@ -35,6 +36,8 @@ type CommonConfig struct {
 	GaeHeadfirst        bool
 	GaeObfuscate        bool
 	GaeValidate         bool
+	GaeDeadline         int
+	GaeMaxsize          int
 	GaeTransport        bool
 	GaeOptions          []string
 	GaeRegions          []string
@@ -45,8 +48,6 @@ type CommonConfig struct {
 	PacPort             int
 	PacFile             string
 	PacGfwlist          string
-	PacAdblock          string
-	PacAdmode           int
 	PacExpired          int
 	PhpEnable           bool
 	PhpListen           string
@@ -59,6 +60,8 @@ type CommonConfig struct {
 	VpsEnable           bool
 	VpsListen           string
 	VpsFetchserver      []string
+	ShadowsocksEnable   bool
+	ShadowsocksServer   []string
 	ProxyEnable         bool
 	ProxyAutodetect     bool
 	ProxyHost           string
@@ -86,6 +89,7 @@ type CommonConfig struct {
 	IplistFixed       []string
 	HostMap           map[string]string
 	UrlRewriteMap     map[string]string
+	ProxyMap          map[string]string
 	CrlfSites         []string
 	NocrlfSites       []string
 	ForcehttpsSites   []string
@@ -95,6 +99,7 @@ type CommonConfig struct {
 	WithGAESites      []string
 	WithPHPSites      []string
 	WithVPSSites      []string
+	WithSSSites       []string
 }
 
 type GoConfig map[string]map[string]string
@@ -174,6 +179,25 @@ func (c GoConfig) GetBool(section string, option string) bool {
 	}
 }
 
+// BackendSites returns the [profile] sites of the enabled backends by filter
+// name, the sites of the disabled ones are left to the default route.
+func (cc *CommonConfig) BackendSites() map[string][]string {
+	sites := make(map[string][]string)
+	if cc.GaeEnable {
+		sites["gae"] = cc.WithGAESites
+	}
+	if cc.PhpEnable {
+		sites["php"] = cc.WithPHPSites
+	}
+	if cc.VpsEnable {
+		sites["vps"] = cc.WithVPSSites
+	}
+	if cc.ShadowsocksEnable {
+		sites["shadowsocks"] = cc.WithSSSites
+	}
+	return sites
+}
+
 func (cc *CommonConfig) WriteSummary(w io.Writer) error {
 	fmt.Fprintf(w, "------------------------------------------------------\n")
 	fmt.Fprintf(w, "GoAgent Version    : %s (golang/%s)\n", Version, runtime.Version())
@@ -214,6 +238,9 @@ func (cc *CommonConfig) WriteSummary(w io.Writer) error {
 		fmt.Fprintf(w, "VPS Listen         : %s\n", cc.VpsListen)
 		fmt.Fprintf(w, "VPS FetchServer    : %s", strings.Join(cc.VpsFetchserver, "|"))
 	}
+	if cc.ShadowsocksEnable {
+		fmt.Fprintf(w, "Shadowsocks Server : %s\n", strings.Join(cc.ShadowsocksServer, "|"))
+	}
 	if cc.DnsEnable {
 		fmt.Fprintf(w, "DNS Listen         : %s\n", cc.DnsListen)
 		fmt.Fprintf(w, "DNS FetchServer    : %s\n", strings.Join(cc.DnsServers, "|"))
@@ -233,6 +260,7 @@ func ReadConfigFile(filename string) (*CommonConfig, error) {
 	cc.ListenPort = c.GetInt("listen", "port")
 	cc.ListenUsername = c.GetString("listen", "username")
 	cc.ListenPassword = c.GetString("listen", "password")
+	cc.ListenHtpasswd = c.GetString("listen", "htpasswd")
 	cc.ListenVisible = c.GetBool("listen", "visible")
 	cc.ListenDebuginfo = c.GetBool("listen", "debuginfo")
 
@@ -249,6 +277,8 @@ func ReadConfigFile(filename string) (*CommonConfig, error) {
 	cc.GaeKeepalive = c.GetBool("gae", "keepalive")
 	cc.GaeObfuscate = c.GetBool("gae", "obfuscate")
 	cc.GaeValidate = c.GetBool("gae", "validate")
+	cc.GaeDeadline = c.GetInt("gae", "deadline")
+	cc.GaeMaxsize = c.GetInt("gae", "maxsize")
 	cc.GaeTransport = c.GetBool("gae", "transport")
 	cc.GaeOptions = c.GetStrings("gae", "options")
 	cc.GaeRegions = c.GetStrings("gae", "regions")
@@ -257,8 +287,6 @@ func ReadConfigFile(filename string) (*CommonConfig, error) {
 	cc.PacIp = c.GetString("pac", "ip")
 	cc.PacPort = c.GetInt("pac", "port")
 	cc.PacFile = c.GetString("pac", "file")
-	cc.PacAdmode = c.GetInt("pac", "admode")
-	cc.PacAdblock = c.GetString("pac", "adblock")
 	cc.PacGfwlist = c.GetString("pac", "gfwlist")
 	cc.PacExpired = c.GetInt("pac", "expired")
 
@@ -275,6 +303,9 @@ func ReadConfigFile(filename string) (*CommonConfig, error) {
 	cc.VpsListen = c.GetString("vps", "listen")
 	cc.VpsFetchserver = c.GetStrings("vps", "fetchserver")
 
+	cc.ShadowsocksEnable = c.GetBool("shadowsocks", "enable")
+	cc.ShadowsocksServer = c.GetStrings("shadowsocks", "server")
+
 	cc.ProxyEnable = c.GetBool("proxy", "enable")
 	cc.ProxyAutodetect = c.GetBool("proxy", "autodetect")
 	cc.ProxyHost = c.GetString("proxy", "host")
@@ -307,6 +338,7 @@ func ReadConfigFile(filename string) (*CommonConfig, error) {
 	cc.IplistFixed = make([]string, 0)
 	cc.HostMap = make(map[string]string, 0)
 	cc.UrlRewriteMap = make(map[string]string, 0)
+	cc.ProxyMap = make(map[string]string, 0)
 	cc.CrlfSites = make([]string, 0)
 	cc.NocrlfSites = make([]string, 0)
 	cc.ForcehttpsSites = make([]string, 0)
@@ -316,6 +348,7 @@ func ReadConfigFile(filename string) (*CommonConfig, error) {
 	cc.WithGAESites = make([]string, 0)
 	cc.WithPHPSites = make([]string, 0)
 	cc.WithVPSSites = make([]string, 0)
+	cc.WithSSSites = make([]string, 0)
 	for _, option := range c.GetOptions("iplist") {
 		cc.IplistMap[option] = c.GetStrings("iplist", option)
 	}
@@ -347,6 +380,8 @@ func ReadConfigFile(filename string) (*CommonConfig, error) {
 				cc.WithPHPSites = append(cc.WithPHPSites, pattern)
 			case "withvps":
 				cc.WithVPSSites = append(cc.WithVPSSites, pattern)
+			case "withss":
+				cc.WithSSSites = append(cc.WithSSSites, pattern)
 			case "direct":
 				cc.HostMap[pattern] = ""
 			default:
@@ -354,6 +389,8 @@ func ReadConfigFile(filename string) (*CommonConfig, error) {
 					cc.HostMap[pattern] = rule
 				} else if strings.Contains(pattern, "\\") {
 					cc.UrlRewriteMap[pattern] = rule
+				} else if strings.Contains(rule, "://") {
+					cc.ProxyMap[pattern] = rule
 				}
 			}
 		}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"github.com/phuslu/goproxy/httpproxy/filters/autorange"
+	"github.com/phuslu/goproxy/httpproxy/filters/gae"
+	"github.com/phuslu/goproxy/httpproxy/filters/php"
+	"github.com/phuslu/goproxy/httpproxy/filters/shadowsocks"
+	"github.com/phuslu/goproxy/httpproxy/filters/vps"
+	"github.com/phuslu/goproxy/netutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"TLSv1":   tls.VersionTLS10,
+	"TLSv1.1": tls.VersionTLS11,
+	"TLSv1.2": tls.VersionTLS12,
+}
+
+// newBackendFilter creates the RoundTripFilter name and configures it from
+// common, its connections go through the parent proxies of dialer.
+func newBackendFilter(name string, common *CommonConfig, dialer *netutil.Dialer) (filters.RoundTripFilter, error) {
+	f, err := filters.NewFilter(name)
+	if err != nil {
+		return nil, err
+	}
+	switch f := f.(type) {
+	case *gae.Filter:
+		if len(common.GaeAppids) == 0 || common.GaeAppids[0] == "" {
+			return nil, fmt.Errorf("no gae appid")
+		}
+		f.AppIDs = common.GaeAppids
+		if common.GaeMode != "" {
+			f.Scheme = common.GaeMode
+		}
+		if common.GaePath != "" {
+			f.Path = strings.TrimSuffix(common.GaePath, "/") + "/"
+		}
+		if common.GaeObfuscate && common.GaePassword == "" {
+			return nil, fmt.Errorf("gae obfuscate needs a password")
+		}
+		f.Password = common.GaePassword
+		f.Validate = common.GaeValidate
+		f.Deadline = time.Duration(common.GaeDeadline) * time.Second
+		f.MaxSize = common.GaeMaxsize
+		f.FetchMax = common.FetchmaxServer
+		f.Obfuscate = common.GaeObfuscate
+		f.Transport, err = newGAETransport(common, dialer)
+		if err != nil {
+			return nil, err
+		}
+	case *php.Filter:
+		for _, rawurl := range common.PhpFetchserver {
+			if rawurl == "" {
+				continue
+			}
+			u, err := url.Parse(rawurl)
+			if err != nil {
+				return nil, err
+			}
+			f.FetchServers = append(f.FetchServers, u)
+		}
+		if len(f.FetchServers) == 0 {
+			return nil, fmt.Errorf("no php fetchserver")
+		}
+		f.Password = common.PhpPassword
+		f.Validate = common.PhpValidate
+		f.Crlf = common.PhpCrlf
+		f.Dial = dialer.Dial
+		f.Transport.DisableKeepAlives = !common.PhpKeepalive
+	case *vps.Filter:
+		for _, rawurl := range common.VpsFetchserver {
+			if rawurl == "" {
+				continue
+			}
+			u, err := url.Parse(rawurl)
+			if err != nil {
+				return nil, err
+			}
+			if _, _, err := net.SplitHostPort(u.Host); err != nil {
+				return nil, fmt.Errorf("vps fetchserver %#v has no port", rawurl)
+			}
+			f.FetchServers = append(f.FetchServers, u)
+		}
+		if len(f.FetchServers) == 0 {
+			return nil, fmt.Errorf("no vps fetchserver")
+		}
+		f.Dial = dialer.Dial
+	case *shadowsocks.Filter:
+		for _, rawurl := range common.ShadowsocksServer {
+			if rawurl == "" {
+				continue
+			}
+			u, err := url.Parse(rawurl)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := shadowsocks.NewCipher(u); err != nil {
+				return nil, err
+			}
+			f.Servers = append(f.Servers, u)
+		}
+		if len(f.Servers) == 0 {
+			return nil, fmt.Errorf("no shadowsocks server")
+		}
+		f.Dial = dialer.Dial
+	}
+	rt, ok := f.(filters.RoundTripFilter)
+	if !ok {
+		return nil, fmt.Errorf("%#v is not a RoundTripFilter", f)
+	}
+	return rt, nil
+}
+
+// nonEmpty returns the non empty strings of ss, the options read as an empty
+// string are dropped.
+func nonEmpty(ss []string) []string {
+	ss1 := make([]string, 0, len(ss))
+	for _, s := range ss {
+		if s != "" {
+			ss1 = append(ss1, s)
+		}
+	}
+	return ss1
+}
+
+// newAutorangeFilter wraps backend to download the [autorange] urls by
+// ranges, backend is returned as is if no url is configured.
+func newAutorangeFilter(common *CommonConfig, backend filters.RoundTripFilter) (filters.RoundTripFilter, error) {
+	hosts, endswith := nonEmpty(common.AutorangeHosts), nonEmpty(common.AutorangeEndswith)
+	if len(hosts) == 0 && len(endswith) == 0 {
+		return backend, nil
+	}
+	f0, err := filters.NewFilter("autorange")
+	if err != nil {
+		return nil, err
+	}
+	f := f0.(*autorange.Filter)
+	f.Backend = backend
+	f.Hosts = hosts
+	f.Endswith = endswith
+	f.Noendswith = nonEmpty(common.AutorangeNoendswith)
+	if common.AutorangeThreads > 0 {
+		f.Threads = common.AutorangeThreads
+	}
+	if common.AutorangeMaxsize > 0 {
+		f.MaxSize = int64(common.AutorangeMaxsize)
+	}
+	if common.AutorangeWaitsize > 0 {
+		f.WaitSize = int64(common.AutorangeWaitsize)
+	}
+	if common.AutorangeBufsize > 0 {
+		f.BufSize = common.AutorangeBufsize
+	}
+	return f, nil
+}
+
+// newGAETransport returns a transport which connects appspot.com with the
+// google_hk iplist in https mode, or with google_cn in http mode. The quality
+// of the iplist is kept in the IPTable of parent.
+func newGAETransport(common *CommonConfig, parent *netutil.Dialer) (*http.Transport, error) {
+	profile := "google_hk"
+	if common.GaeMode == "http" {
+		profile = "google_cn"
+	}
+	iplist, ok := common.IplistMap[profile]
+	if !ok {
+		return nil, fmt.Errorf("iplist %#v not found", profile)
+	}
+	resolver := netutil.NewResolver(nil)
+	resolver.SetHost(profile, iplist)
+	resolver.SetCNAME(".appspot.com", profile)
+
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	if common.GaeSslversion != "" {
+		version, ok := tlsVersions[common.GaeSslversion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported sslversion %#v", common.GaeSslversion)
+		}
+		config.MinVersion = version
+	}
+
+	dialer := &netutil.Dialer{
+		Timeout:        10 * time.Second,
+		KeepAlive:      60 * time.Second,
+		DualStack:      common.GaeIpv6,
+		TLSConfig:      config,
+		DNSResolver:    resolver,
+		ParentProxy:    parent.ParentProxy,
+		ParentProxyFor: parent.ParentProxyFor,
+		IPTable:        parent.IPTable,
+	}
+	return &http.Transport{
+		Dial:                dialer.Dial,
+		DialTLS:             dialer.DialTLS,
+		TLSClientConfig:     config,
+		TLSHandshakeTimeout: 10 * time.Second,
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: common.GaeWindow,
+	}, nil
+}
@@ -5,13 +5,16 @@ import (
 	"github.com/golang/glog"
 	"github.com/phuslu/goproxy/httpproxy"
 	"github.com/phuslu/goproxy/httpproxy/filters"
-	_ "github.com/phuslu/goproxy/httpproxy/filters/direct"
+	"github.com/phuslu/goproxy/httpproxy/filters/auth"
+	"github.com/phuslu/goproxy/httpproxy/filters/direct"
 	// _ "github.com/phuslu/goproxy/httpproxy/filters/imagez"
 	_ "github.com/phuslu/goproxy/httpproxy/filters/mock"
+	"github.com/phuslu/goproxy/httpproxy/filters/route"
 	_ "github.com/phuslu/goproxy/httpproxy/filters/strip"
 	"github.com/phuslu/goproxy/netutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"time"
@@ -26,12 +29,6 @@ func main() {
 		glog.Fatalf("ReadConfigFile() failed: %s", err)
 	}
 
-	addr := net.JoinHostPort(common.ListenIp, strconv.Itoa(common.ListenPort))
-	ln, err := netutil.Listen("tcp4", addr)
-	if err != nil {
-		glog.Fatalf("Listen(\"tcp4\", %s) failed: %s", addr, err)
-	}
-
 	resolver := netutil.NewResolver(nil)
 	for name, iplist := range common.IplistMap {
 		resolver.SetHost(name, iplist)
@@ -44,8 +41,65 @@ func main() {
 		Timeout:     30 * time.Second,
 		KeepAlive:   30 * time.Second,
 		DNSResolver: resolver,
+		IPTable:     &netutil.IPTable{},
+	}
+	if common.ProxyEnable {
+		dialer.ParentProxy = &url.URL{
+			Scheme: "http",
+			Host:   net.JoinHostPort(common.ProxyHost, strconv.Itoa(common.ProxyPort)),
+		}
+		if common.ProxyUsername != "" {
+			dialer.ParentProxy.User = url.UserPassword(common.ProxyUsername, common.ProxyPasswrod)
+		}
+	}
+	if len(common.ProxyMap) > 0 {
+		proxyRouter := &route.Filter{}
+		proxies := make(map[string]*url.URL)
+		for host, rawurl := range common.ProxyMap {
+			u, err := url.Parse(rawurl)
+			if err != nil {
+				glog.Warningf("url.Parse(%#v) failed: %s", rawurl, err)
+				continue
+			}
+			if err := proxyRouter.AddRule(host, rawurl); err != nil {
+				glog.Warningf("proxyRouter.AddRule(%#v, %#v) failed: %s", host, rawurl, err)
+				continue
+			}
+			proxies[rawurl] = u
+		}
+		dialer.ParentProxyFor = func(addr string) *url.URL {
+			if u, ok := proxies[proxyRouter.Route(&http.Request{Method: "CONNECT", Host: addr})]; ok {
+				return u
+			}
+			return dialer.ParentProxy
+		}
 	}
 
+	socks := &netutil.SocksServer{
+		Timeout:    30 * time.Second,
+		Dial:       dialer.Dial,
+		UDPTimeout: 60 * time.Second,
+		// udp is only relayed directly
+		NoUDP: common.ProxyEnable,
+	}
+	requestFilters := []filters.RequestFilter{}
+	if common.ListenUsername != "" || common.ListenHtpasswd != "" {
+		authFilter, err := filters.NewFilter("auth")
+		if err != nil {
+			glog.Fatalf("filters.NewFilter(\"auth\") failed: %s", err)
+		}
+		auther := authFilter.(*auth.Filter)
+		if common.ListenUsername != "" {
+			auther.AddUser(common.ListenUsername, common.ListenPassword)
+		}
+		if common.ListenHtpasswd != "" {
+			if err := auther.LoadFile(common.ListenHtpasswd); err != nil {
+				glog.Fatalf("auth.LoadFile(%#v) failed: %s", common.ListenHtpasswd, err)
+			}
+		}
+		socks.Auth = auther.CheckPassword
+		requestFilters = append(requestFilters, auther)
+	}
 	stripFiler, err := filters.NewFilter("strip")
 	if err != nil {
 		glog.Fatalf("filters.NewFilter(\"strip\") failed: %s", err)
@@ -54,6 +108,59 @@ func main() {
 	if err != nil {
 		glog.Fatalf("filters.NewFilter(\"direct\") failed: %s", err)
 	}
+	// the direct connections resolve with the iplists and feed the IPTable
+	df := directFilter.(*direct.Filter)
+	df.Transport.Dial = dialer.Dial
+	if dialer.ParentProxy != nil || dialer.ParentProxyFor != nil {
+		df.ProxyTransport = &netutil.ProxyTransport{
+			Dialer:    dialer,
+			Transport: df.Transport,
+		}
+	}
+	routeFilter, err := filters.NewFilter("route")
+	if err != nil {
+		glog.Fatalf("filters.NewFilter(\"route\") failed: %s", err)
+	}
+	router := routeFilter.(*route.Filter)
+	directBackend, err := newAutorangeFilter(common, directFilter.(filters.RoundTripFilter))
+	if err != nil {
+		glog.Fatalf("newAutorangeFilter(\"direct\") failed: %s", err)
+	}
+	router.SetBackend("direct", directBackend)
+	for host, name := range common.HostMap {
+		if name == "" {
+			if err := router.AddRule(host, "direct"); err != nil {
+				glog.Warningf("router.AddRule(%#v, \"direct\") failed: %s", host, err)
+			}
+		}
+	}
+	for name, sites := range common.BackendSites() {
+		if len(sites) == 0 {
+			continue
+		}
+		f, err := newBackendFilter(name, common, dialer)
+		if err != nil {
+			glog.Warningf("newBackendFilter(%#v) failed: %s, ignore %d sites", name, err, len(sites))
+			continue
+		}
+		if f, err = newAutorangeFilter(common, f); err != nil {
+			glog.Warningf("newAutorangeFilter(%#v) failed: %s, ignore %d sites", name, err, len(sites))
+			continue
+		}
+		router.SetBackend(name, f)
+		for _, site := range sites {
+			if err := router.AddRule(site, name); err != nil {
+				glog.Warningf("router.AddRule(%#v, %#v) failed: %s", site, name, err)
+			}
+		}
+	}
+
+	addr := net.JoinHostPort(common.ListenIp, strconv.Itoa(common.ListenPort))
+	ln, err := netutil.ListenSocks("tcp4", addr, socks)
+	if err != nil {
+		glog.Fatalf("ListenSocks(\"tcp4\", %s) failed: %s", addr, err)
+	}
+
 	h := httpproxy.Handler{
 		Listener: ln,
 		Transport: &http.Transport{
@@ -65,11 +172,9 @@ func main() {
 			DisableCompression:    true,
 			Proxy:                 nil,
 		},
-		RequestFilters: []filters.RequestFilter{
-			stripFiler.(filters.RequestFilter),
-		},
+		RequestFilters: append(requestFilters, stripFiler.(filters.RequestFilter)),
 		RoundTripFilters: []filters.RoundTripFilter{
-			directFilter.(filters.RoundTripFilter),
+			router,
 		},
 		ResponseFilters: []filters.ResponseFilter{},
 	}
@@ -79,7 +184,30 @@ func main() {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
+	if common.PacEnable {
+		pacAddr := net.JoinHostPort(common.PacIp, strconv.Itoa(common.PacPort))
+		go func() {
+			glog.Infof("PAC ListenAndServe on %s\n", pacAddr)
+			mux := http.NewServeMux()
+			mux.Handle("/", NewPACHandler(common))
+			// the pac server listens on all the interfaces
+			mux.Handle("/iptable", loopbackOnly(dialer.IPTable))
+			glog.Exitln(http.ListenAndServe(pacAddr, mux))
+		}()
+	}
 	common.WriteSummary(os.Stderr)
 	glog.Infof("ListenAndServe on %s\n", h.Listener.Addr().String())
 	glog.Exitln(s.Serve(h.Listener))
 }
+
+// loopbackOnly serves h to the clients on the loopback only.
+func loopbackOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(rw, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
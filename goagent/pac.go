@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/phuslu/goproxy/autoproxy"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pacRetry is the time before another update of the gfwlist after a failed
+// one.
+const pacRetry = 5 * time.Minute
+
+type PACHandler struct {
+	common      *CommonConfig
+	gfwlistFile string
+	expired     time.Duration
+	client      *http.Client
+	mu          sync.Mutex
+	gfwlist     *autoproxy.RuleList
+	updating    bool
+	// next is the time of the next update, PacExpired after a successful
+	// one and pacRetry after a failed one.
+	next time.Time
+}
+
+func NewPACHandler(common *CommonConfig) *PACHandler {
+	gfwlistFile := ""
+	if common.PacGfwlist != "" {
+		if u, err := url.Parse(common.PacGfwlist); err == nil {
+			gfwlistFile = path.Base(u.Path)
+		}
+	}
+
+	// fetch gfwlist through our own listener, it is usually blocked.
+	proxyHost := common.ListenIp
+	if ip := net.ParseIP(proxyHost); ip == nil || ip.IsUnspecified() {
+		proxyHost = "127.0.0.1"
+	}
+	proxyURL := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(proxyHost, strconv.Itoa(common.ListenPort)),
+	}
+	if common.ListenUsername != "" {
+		proxyURL.User = url.UserPassword(common.ListenUsername, common.ListenPassword)
+	}
+
+	h := &PACHandler{
+		common:      common,
+		gfwlistFile: gfwlistFile,
+		expired:     time.Duration(common.PacExpired) * time.Second,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyURL(proxyURL),
+			},
+			Timeout: 60 * time.Second,
+		},
+	}
+	// the cached gfwlist serves the first requests, until the update
+	if gfwlistFile != "" {
+		if l, err := autoproxy.ParseFile(gfwlistFile, autoproxy.Proxy); err == nil {
+			h.gfwlist = l
+		}
+	}
+	return h
+}
+
+func (h *PACHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/"+strings.TrimLeft(h.common.PacFile, "/") {
+		http.NotFound(rw, req)
+		return
+	}
+
+	h.update()
+
+	host := h.common.ListenIp
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = req.Host
+		if host1, _, err := net.SplitHostPort(host); err == nil {
+			host = host1
+		}
+	}
+	proxy := fmt.Sprintf("PROXY %s", net.JoinHostPort(host, strconv.Itoa(h.common.ListenPort)))
+
+	var b bytes.Buffer
+	h.mu.Lock()
+	err := h.generate(&b, proxy)
+	h.mu.Unlock()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	glog.Infof("%s \"PAC %s %s %s\" %d %d", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, http.StatusOK, b.Len())
+	rw.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	rw.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(b.Bytes())
+}
+
+// update starts a refresh in the background when one is due, the PAC
+// requests meanwhile get the rules loaded before.
+func (h *PACHandler) update() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.updating || time.Now().Before(h.next) {
+		return
+	}
+	h.updating = true
+	go h.refresh()
+}
+
+// refresh reloads the gfwlist rules, downloading a fresh copy when the local
+// cache is older than PacExpired, and rewrites PacFile.
+func (h *PACHandler) refresh() (err error) {
+	defer func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.updating = false
+		if err != nil {
+			glog.Warningf("PACHandler update error: %s, retry in %s", err, pacRetry)
+			h.next = time.Now().Add(pacRetry)
+		} else {
+			h.next = time.Now().Add(h.expired)
+		}
+	}()
+
+	var gfwlist *autoproxy.RuleList
+	if h.gfwlistFile != "" {
+		if fi, err1 := os.Stat(h.gfwlistFile); err1 != nil || time.Since(fi.ModTime()) > h.expired {
+			if err = h.download(); err != nil {
+				glog.Warningf("PACHandler download %#v error: %s", h.common.PacGfwlist, err)
+			}
+		}
+		if l, err1 := autoproxy.ParseFile(h.gfwlistFile, autoproxy.Proxy); err1 == nil {
+			gfwlist = l
+		} else if err == nil {
+			err = err1
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if gfwlist != nil {
+		h.gfwlist = gfwlist
+	}
+	if h.common.PacFile != "" {
+		host := h.common.ListenIp
+		if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		var b bytes.Buffer
+		if err1 := h.generate(&b, fmt.Sprintf("PROXY %s", net.JoinHostPort(host, strconv.Itoa(h.common.ListenPort)))); err1 == nil {
+			if err1 = ioutil.WriteFile(h.common.PacFile, b.Bytes(), 0644); err1 != nil && err == nil {
+				err = err1
+			}
+		}
+	}
+
+	return err
+}
+
+func (h *PACHandler) download() error {
+	resp, err := h.client.Get(h.common.PacGfwlist)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s return %s", h.common.PacGfwlist, resp.Status)
+	}
+
+	tmp := h.gfwlistFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, h.gfwlistFile)
+}
+
+func jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// generate writes a PAC script. [profile] rules come first, then the gfwlist
+// rules, and everything else goes direct.
+func (h *PACHandler) generate(w io.Writer, proxy string) error {
+	hosts := make(map[string]string)
+	wildcards := make(map[string]string)
+	regexps := make(map[string]string)
+
+	addSite := func(pattern, action string) {
+		switch {
+		case strings.Contains(pattern, "\\"):
+			regexps[pattern] = action
+		default:
+			if host, _, err := net.SplitHostPort(pattern); err == nil {
+				pattern = host
+			}
+			pattern = strings.ToLower(pattern)
+			if strings.ContainsAny(pattern, "*?") {
+				wildcards[pattern] = action
+			} else {
+				hosts[pattern] = action
+			}
+		}
+	}
+
+	for pattern, name := range h.common.HostMap {
+		if name == "" {
+			addSite(pattern, "DIRECT")
+		} else {
+			addSite(pattern, proxy)
+		}
+	}
+	for pattern := range h.common.UrlRewriteMap {
+		addSite(pattern, proxy)
+	}
+	for _, sites := range h.common.BackendSites() {
+		for _, pattern := range sites {
+			addSite(pattern, proxy)
+		}
+	}
+
+	domains := make(map[string]int)
+	patterns := make([]string, 0)
+	excPatterns := make([]string, 0)
+	if h.gfwlist != nil {
+		for _, rule := range h.gfwlist.Rules {
+			switch {
+			case rule.Domain != "" && rule.Exception:
+				domains[rule.Domain] = 0
+			case rule.Domain != "":
+				if _, ok := domains[rule.Domain]; !ok {
+					domains[rule.Domain] = 1
+				}
+			case rule.Exception:
+				excPatterns = append(excPatterns, rule.Pattern)
+			default:
+				patterns = append(patterns, rule.Pattern)
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, `// Generated by GoAgent %s at %s
+
+var proxy = %s;
+var hosts = %s;
+var wildcards = %s;
+var regexps = %s;
+var domains = %s;
+var patterns = %s;
+var excPatterns = %s;
+
+function matchPatterns(url, patterns) {
+    for (var i = 0; i < patterns.length; i++) {
+        if (new RegExp(patterns[i]).test(url)) {
+            return true;
+        }
+    }
+    return false;
+}
+
+function FindProxyForURL(url, host) {
+    host = host.toLowerCase();
+    if (isPlainHostName(host) || host === "127.0.0.1" || host === "localhost") {
+        return "DIRECT";
+    }
+
+    if (hosts.hasOwnProperty(host)) {
+        return hosts[host];
+    }
+    var pos = host.indexOf(".");
+    while (pos >= 0) {
+        var suffix = host.substring(pos);
+        if (hosts.hasOwnProperty(suffix)) {
+            return hosts[suffix];
+        }
+        pos = host.indexOf(".", pos + 1);
+    }
+    for (var pattern in wildcards) {
+        if (shExpMatch(host, pattern)) {
+            return wildcards[pattern];
+        }
+    }
+    for (var pattern in regexps) {
+        if (new RegExp(pattern).test(url)) {
+            return regexps[pattern];
+        }
+    }
+
+    var domain = host;
+    while (true) {
+        if (domains.hasOwnProperty(domain)) {
+            return domains[domain] ? proxy : "DIRECT";
+        }
+        pos = domain.indexOf(".");
+        if (pos < 0) {
+            break;
+        }
+        domain = domain.substring(pos + 1);
+    }
+    if (matchPatterns(url, excPatterns)) {
+        return "DIRECT";
+    }
+    if (matchPatterns(url, patterns)) {
+        return proxy;
+    }
+
+    return "DIRECT";
+}
+`,
+		Version, time.Now().Format(time.RFC1123),
+		jsonString(proxy),
+		jsonString(hosts),
+		jsonString(wildcards),
+		jsonString(regexps),
+		jsonString(domains),
+		jsonString(patterns),
+		jsonString(excPatterns))
+	return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/phuslu/goproxy/autoproxy"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pacVar decodes the value of the variable name of a PAC script.
+func pacVar(t *testing.T, script, name string, v interface{}) {
+	prefix := "\nvar " + name + " = "
+	i := strings.Index(script, prefix)
+	if i < 0 {
+		t.Fatalf("PAC has no var %s", name)
+	}
+	value := script[i+len(prefix):]
+	value = value[:strings.Index(value, ";\n")]
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		t.Fatalf("var %s = %s: %s", name, value, err)
+	}
+}
+
+func TestPACGenerate(t *testing.T) {
+	const proxy = "PROXY 127.0.0.1:8087"
+	gfwlist, err := autoproxy.Parse(strings.NewReader("||blocked.com\n@@||ok.blocked.com\n|http://pat.example.org\n@@|http://pat.example.org/ok\n"), autoproxy.Proxy)
+	if err != nil {
+		t.Fatalf("autoproxy.Parse error: %s", err)
+	}
+	h := &PACHandler{
+		common: &CommonConfig{
+			HostMap: map[string]string{
+				"www.example.com":              "google_hk",
+				".direct.example.com":          "",
+				"*.wild.example.com":           "google_hk",
+				`https?://re\.example\.com/.*`: "google_hk",
+			},
+			// the sites of a disabled backend are left out
+			VpsEnable:    true,
+			WithVPSSites: []string{"vps.example.com"},
+			WithPHPSites: []string{"php.example.com"},
+		},
+		gfwlist: gfwlist,
+	}
+	var b bytes.Buffer
+	if err := h.generate(&b, proxy); err != nil {
+		t.Fatalf("generate error: %s", err)
+	}
+	script := b.String()
+
+	var proxy1 string
+	pacVar(t, script, "proxy", &proxy1)
+	if proxy1 != proxy {
+		t.Errorf("proxy = %#v, want %#v", proxy1, proxy)
+	}
+	for _, c := range []struct {
+		name string
+		want map[string]string
+	}{
+		{"hosts", map[string]string{"www.example.com": proxy, ".direct.example.com": "DIRECT", "vps.example.com": proxy}},
+		{"wildcards", map[string]string{"*.wild.example.com": proxy}},
+		{"regexps", map[string]string{`https?://re\.example\.com/.*`: proxy}},
+	} {
+		var got map[string]string
+		pacVar(t, script, c.name, &got)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	// the exceptions of the gfwlist go direct
+	var domains map[string]int
+	pacVar(t, script, "domains", &domains)
+	if want := map[string]int{"blocked.com": 1, "ok.blocked.com": 0}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("domains = %v, want %v", domains, want)
+	}
+	for _, c := range []struct {
+		name string
+		url  string
+	}{
+		{"patterns", "http://pat.example.org/a"},
+		{"excPatterns", "http://pat.example.org/ok"},
+	} {
+		var patterns []string
+		pacVar(t, script, c.name, &patterns)
+		if len(patterns) != 1 || !regexp.MustCompile(patterns[0]).MatchString(c.url) {
+			t.Errorf("%s = %v, want one matching %s", c.name, patterns, c.url)
+		}
+	}
+}
+
+func TestPACUpdateRetry(t *testing.T) {
+	var fail int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(rw, "[AutoProxy 0.2.9]\n||example.com\n")
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pac")
+	if err != nil {
+		t.Fatalf("TempDir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := NewPACHandler(&CommonConfig{PacGfwlist: server.URL + "/gfwlist.txt", PacExpired: 3600})
+	h.gfwlistFile = filepath.Join(dir, "gfwlist.txt")
+	h.client = server.Client()
+
+	// a failed download is retried before PacExpired
+	if err := h.refresh(); err == nil {
+		t.Fatalf("refresh succeeded with the download failing")
+	}
+	if h.gfwlist != nil || h.next.After(time.Now().Add(pacRetry)) {
+		t.Errorf("after a failure gfwlist = %v, next in %s, want nil, %s", h.gfwlist, time.Until(h.next), pacRetry)
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	if err := h.refresh(); err != nil {
+		t.Fatalf("refresh error: %s", err)
+	}
+	if h.gfwlist == nil || len(h.gfwlist.Rules) != 1 || h.next.Before(time.Now().Add(pacRetry)) {
+		t.Errorf("after a success gfwlist = %v, next in %s, want 1 rule, %s", h.gfwlist, time.Until(h.next), h.expired)
+	}
+}
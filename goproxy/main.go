@@ -9,17 +9,28 @@ import (
 	_ "github.com/phuslu/goproxy/httpproxy/filters/imagez"
 	_ "github.com/phuslu/goproxy/httpproxy/filters/mock"
 	"github.com/phuslu/goproxy/netutil"
+	"net"
 	"net/http"
 	"time"
 )
 
 func main() {
-	addr := *flag.String("addr", "127.0.0.1:8000", "GoProxy Listen Address")
+	addr := flag.String("addr", "127.0.0.1:8000", "GoProxy Listen Address")
+	key := flag.String("key", "", "Serve the vps filter of goagent with this key")
 	flag.Parse()
 
-	ln, err := netutil.Listen("tcp", addr)
+	var ln net.Listener
+	var err error
+	if *key != "" {
+		ln, err = netutil.ListenCipher("tcp", *addr, []byte(*key))
+		if err == nil {
+			ln = netutil.MuxListener(ln, nil)
+		}
+	} else {
+		ln, err = netutil.Listen("tcp", *addr)
+	}
 	if err != nil {
-		glog.Fatalf("Listen(\"tcp\", %s) failed: %s", addr, err)
+		glog.Fatalf("Listen(\"tcp\", %s) failed: %s", *addr, err)
 	}
 
 	directFilter, err := filters.NewFilter("direct")
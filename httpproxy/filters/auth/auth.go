@@ -0,0 +1,365 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRealm string        = "GoAgent"
+	NonceExpires time.Duration = 5 * time.Minute
+)
+
+type Filter struct {
+	filters.RequestFilter
+	Realm string
+	// Digest allows the Digest scheme, which is offered only once htdigest
+	// entries are loaded and no user has an htpasswd hash, as browsers
+	// prefer it to Basic.
+	Digest bool
+	users  map[string]*credential
+	secret []byte
+	mu     sync.Mutex
+	// ncs are the last nonce counts used with the nonces, purged of the
+	// expired nonces every NonceExpires
+	ncs    map[string]nonceCount
+	purged time.Time
+}
+
+type nonceCount struct {
+	nc      uint64
+	expires time.Time
+}
+
+// credential holds whatever is known about a user's password: the plain text,
+// an htpasswd hash ({SHA}, apr1, MD5-crypt or bcrypt) and/or an htdigest HA1.
+type credential struct {
+	password string
+	hash     string
+	ha1      string
+}
+
+func init() {
+	filters.Register("auth", &filters.RegisteredFilter{
+		New: NewFilter,
+	})
+}
+
+func NewFilter() (filters.Filter, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &Filter{
+		Realm:  DefaultRealm,
+		Digest: true,
+		users:  make(map[string]*credential),
+		secret: secret,
+		ncs:    make(map[string]nonceCount),
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return "auth"
+}
+
+// AddUser adds a user with a plain text password.
+func (f *Filter) AddUser(username, password string) {
+	f.users[username] = &credential{password: password}
+}
+
+// LoadFile reads users from an htpasswd file ("user:password",
+// "user:{SHA}...", "user:$apr1$...", "user:$1$..." or "user:$2y$...") or an
+// htdigest file ("user:realm:ha1"). Other hashes starting with "$" are
+// rejected.
+func (f *Filter) LoadFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		switch {
+		case len(parts) == 3 && len(parts[2]) == 32 && parts[1] == f.Realm:
+			f.users[parts[0]] = &credential{ha1: strings.ToLower(parts[2])}
+		case len(parts) == 3:
+			// htdigest entry of another realm
+			continue
+		case len(parts) == 2 && (strings.HasPrefix(parts[1], "{SHA}") || strings.HasPrefix(parts[1], "$apr1$") || strings.HasPrefix(parts[1], "$1$") || strings.HasPrefix(parts[1], "$2")):
+			f.users[parts[0]] = &credential{hash: parts[1]}
+		case len(parts) == 2 && strings.HasPrefix(parts[1], "$"):
+			return fmt.Errorf("auth: unsupported hash of user %#v in %#v", parts[0], filename)
+		case len(parts) == 2:
+			f.users[parts[0]] = &credential{password: parts[1]}
+		default:
+			return fmt.Errorf("auth: invalid line %#v in %#v", line, filename)
+		}
+	}
+	return scanner.Err()
+}
+
+// digest reports whether the Digest scheme is offered.
+func (f *Filter) digest() bool {
+	if !f.Digest {
+		return false
+	}
+	ha1 := false
+	for _, c := range f.users {
+		if c.hash != "" {
+			return false
+		}
+		if c.ha1 != "" {
+			ha1 = true
+		}
+	}
+	return ha1
+}
+
+func md5hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// CheckPassword reports whether password is right for username.
+func (f *Filter) CheckPassword(username, password string) bool {
+	c, ok := f.users[username]
+	if !ok {
+		return false
+	}
+	switch {
+	case c.ha1 != "":
+		return subtle.ConstantTimeCompare([]byte(c.ha1), []byte(md5hex(username+":"+f.Realm+":"+password))) == 1
+	case strings.HasPrefix(c.hash, "{SHA}"):
+		h := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(c.hash[5:]), []byte(base64.StdEncoding.EncodeToString(h[:]))) == 1
+	case strings.HasPrefix(c.hash, "$apr1$"):
+		return subtle.ConstantTimeCompare([]byte(c.hash), []byte(md5Crypt(password, c.hash, "$apr1$"))) == 1
+	case strings.HasPrefix(c.hash, "$1$"):
+		return subtle.ConstantTimeCompare([]byte(c.hash), []byte(md5Crypt(password, c.hash, "$1$"))) == 1
+	case c.hash != "":
+		return bcrypt.CompareHashAndPassword([]byte(c.hash), []byte(password)) == nil
+	default:
+		return subtle.ConstantTimeCompare([]byte(c.password), []byte(password)) == 1
+	}
+}
+
+// newNonce returns "timestamp:hmac(timestamp)", which can be verified without
+// keeping server side state.
+func (f *Filter) newNonce() string {
+	ts := strconv.FormatInt(time.Now().Unix(), 16)
+	mac := hmac.New(sha1.New, f.secret)
+	mac.Write([]byte(ts))
+	return ts + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkNonce returns valid and stale.
+func (f *Filter) checkNonce(nonce string) (bool, bool) {
+	parts := strings.SplitN(nonce, ":", 2)
+	if len(parts) != 2 {
+		return false, false
+	}
+	mac := hmac.New(sha1.New, f.secret)
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal([]byte(parts[1]), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return false, false
+	}
+	ts, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return false, false
+	}
+	if time.Since(time.Unix(ts, 0)) > NonceExpires {
+		return true, true
+	}
+	return true, false
+}
+
+func parseDigestParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t,")
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			j := strings.IndexByte(s[1:], '"')
+			if j < 0 {
+				break
+			}
+			value = s[1 : j+1]
+			s = s[j+2:]
+		} else {
+			j := strings.IndexByte(s, ',')
+			if j < 0 {
+				j = len(s)
+			}
+			value = strings.TrimSpace(s[:j])
+			s = s[j:]
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// digestURIMatches reports whether uri of a Digest response is the target of
+// req, the authority for CONNECT.
+func digestURIMatches(req *http.Request, uri string) bool {
+	if req.RequestURI != "" && uri == req.RequestURI {
+		return true
+	}
+	if req.Method == "CONNECT" {
+		return uri == req.Host
+	}
+	return uri == req.URL.String() || uri == req.URL.RequestURI()
+}
+
+// useNonceCount reports whether nc is greater than the counts used before
+// with nonce, a valid one, and records it.
+func (f *Filter) useNonceCount(nonce, nc string) bool {
+	n, err := strconv.ParseUint(nc, 16, 64)
+	if err != nil {
+		return false
+	}
+	ts, err := strconv.ParseInt(strings.SplitN(nonce, ":", 2)[0], 16, 64)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if last, ok := f.ncs[nonce]; ok && n <= last.nc {
+		return false
+	}
+	f.ncs[nonce] = nonceCount{n, time.Unix(ts, 0).Add(NonceExpires)}
+	if now.Sub(f.purged) > NonceExpires {
+		for nonce1, c := range f.ncs {
+			if now.After(c.expires) {
+				delete(f.ncs, nonce1)
+			}
+		}
+		f.purged = now
+	}
+	return true
+}
+
+// checkDigest returns the username, whether the response is valid and whether
+// the nonce was stale. The response must be for the target of req, and the
+// nonce count must increase so that it cannot be replayed.
+func (f *Filter) checkDigest(req *http.Request, params map[string]string) (string, bool, bool) {
+	username := params["username"]
+	c, ok := f.users[username]
+	if !ok || params["realm"] != f.Realm || !digestURIMatches(req, params["uri"]) {
+		return username, false, false
+	}
+
+	var ha1 string
+	switch {
+	case c.ha1 != "":
+		ha1 = c.ha1
+	case c.hash == "":
+		ha1 = md5hex(username + ":" + f.Realm + ":" + c.password)
+	default:
+		// hashed htpasswd entries only work with Basic
+		return username, false, false
+	}
+
+	valid, stale := f.checkNonce(params["nonce"])
+	if !valid {
+		return username, false, false
+	}
+
+	// without qop there is no nonce count to stop replays
+	if params["qop"] != "auth" {
+		return username, false, false
+	}
+	ha2 := md5hex(req.Method + ":" + params["uri"])
+	response := md5hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+	if subtle.ConstantTimeCompare([]byte(response), []byte(strings.ToLower(params["response"]))) != 1 {
+		return username, false, false
+	}
+	if !stale && !f.useNonceCount(params["nonce"], params["nc"]) {
+		return username, false, false
+	}
+	return username, true, stale
+}
+
+func (f *Filter) challenge(ctx *filters.Context, req *http.Request, stale bool) {
+	rw := ctx.GetResponseWriter()
+	rw.Header().Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=\"%s\"", f.Realm))
+	if f.digest() {
+		rw.Header().Add("Proxy-Authenticate", fmt.Sprintf("Digest realm=\"%s\", qop=\"auth\", nonce=\"%s\", algorithm=MD5, stale=%v", f.Realm, f.newNonce(), stale))
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if req.Method == "CONNECT" {
+		rw.Header().Set("Connection", "close")
+	}
+	rw.WriteHeader(http.StatusProxyAuthRequired)
+	fmt.Fprintf(rw, "<html><body><h1>%d %s</h1></body></html>\n", http.StatusProxyAuthRequired, http.StatusText(http.StatusProxyAuthRequired))
+}
+
+func (f *Filter) Request(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Request, error) {
+	if len(f.users) == 0 {
+		return ctx, req, nil
+	}
+
+	// requests inside a tunnel opened by the strip filter were authorized
+	// on CONNECT already
+	if req.TLS != nil {
+		return ctx, req, nil
+	}
+
+	auth := req.Header.Get("Proxy-Authorization")
+	var username string
+	var ok, stale bool
+	switch {
+	case strings.HasPrefix(auth, "Basic "):
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[6:]))
+		if err == nil {
+			parts := strings.SplitN(string(b), ":", 2)
+			if len(parts) == 2 {
+				username = parts[0]
+				ok = f.CheckPassword(parts[0], parts[1])
+			}
+		}
+	case strings.HasPrefix(auth, "Digest ") && f.digest():
+		username, ok, stale = f.checkDigest(req, parseDigestParams(auth[7:]))
+	}
+
+	if !ok || stale {
+		if auth != "" && !stale {
+			glog.Warningf("%s \"AUTH %s %s %s\" user %#v authentication failed", req.RemoteAddr, req.Method, req.Host, req.Proto, username)
+		}
+		f.challenge(ctx, req, stale)
+		return ctx, nil, nil
+	}
+
+	(*ctx)["__username__"] = username
+	req.Header.Del("Proxy-Authorization")
+	return ctx, req, nil
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFilter(t *testing.T) *Filter {
+	f, err := NewFilter()
+	if err != nil {
+		t.Fatalf("NewFilter() error: %s", err)
+	}
+	return f.(*Filter)
+}
+
+func doRequest(f *Filter, method, auth string) (*httptest.ResponseRecorder, *http.Request) {
+	req, _ := http.NewRequest(method, "http://www.example.com/", nil)
+	if method == "CONNECT" {
+		req.Host = "www.example.com:443"
+	}
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	rw := httptest.NewRecorder()
+	ctx := &filters.Context{"__responsewriter__": rw}
+	_, req, _ = f.Request(ctx, req)
+	return rw, req
+}
+
+func TestBasic(t *testing.T) {
+	f := newTestFilter(t)
+	f.AddUser("alice", "secret")
+
+	rw, req := doRequest(f, "CONNECT", "")
+	if req != nil || rw.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("no credentials: Code = %d, want %d", rw.Code, http.StatusProxyAuthRequired)
+	}
+	if len(rw.HeaderMap["Proxy-Authenticate"]) != 1 {
+		t.Errorf("Proxy-Authenticate = %v, want Basic only without htdigest entries", rw.HeaderMap["Proxy-Authenticate"])
+	}
+
+	rw, req = doRequest(f, "CONNECT", "Basic YWxpY2U6d3Jvbmc=")
+	if req != nil || rw.Code != http.StatusProxyAuthRequired {
+		t.Errorf("wrong password: Code = %d, want %d", rw.Code, http.StatusProxyAuthRequired)
+	}
+
+	_, req = doRequest(f, "CONNECT", "Basic YWxpY2U6c2VjcmV0")
+	if req == nil {
+		t.Fatalf("right password rejected")
+	}
+	if req.Header.Get("Proxy-Authorization") != "" {
+		t.Errorf("Proxy-Authorization was not removed")
+	}
+}
+
+func TestDigest(t *testing.T) {
+	f := newTestFilter(t)
+	f.users["alice"] = &credential{ha1: md5hex("alice:" + f.Realm + ":secret")}
+
+	rw, _ := doRequest(f, "GET", "")
+	if len(rw.HeaderMap["Proxy-Authenticate"]) != 2 {
+		t.Errorf("Proxy-Authenticate = %v, want Basic and Digest", rw.HeaderMap["Proxy-Authenticate"])
+	}
+	// a hashed htpasswd user cannot answer Digest
+	f.users["bob"] = &credential{hash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="}
+	rw, _ = doRequest(f, "GET", "")
+	if len(rw.HeaderMap["Proxy-Authenticate"]) != 1 {
+		t.Errorf("Proxy-Authenticate = %v, want Basic only with hashed users", rw.HeaderMap["Proxy-Authenticate"])
+	}
+	delete(f.users, "bob")
+
+	nonce := f.newNonce()
+	ha1 := md5hex("alice:" + f.Realm + ":secret")
+	ha2 := md5hex("GET:/")
+	response := md5hex(ha1 + ":" + nonce + ":00000001:0a4f113b:auth:" + ha2)
+
+	auth := fmt.Sprintf(`Digest username="alice", realm="%s", nonce="%s", uri="/", qop=auth, nc=00000001, cnonce="0a4f113b", response="%s"`, f.Realm, nonce, response)
+	if _, req := doRequest(f, "GET", auth); req == nil {
+		t.Errorf("valid digest rejected")
+	}
+
+	// replayed
+	if rw, req := doRequest(f, "GET", auth); req != nil || rw.Code != http.StatusProxyAuthRequired {
+		t.Errorf("replayed digest accepted")
+	}
+
+	auth = strings.Replace(auth, "nc=00000001", "nc=00000002", 1)
+	if rw, req := doRequest(f, "GET", auth); req != nil || rw.Code != http.StatusProxyAuthRequired {
+		t.Errorf("invalid digest accepted")
+	}
+
+	// the next count is accepted, for its uri only
+	response = md5hex(ha1 + ":" + nonce + ":00000002:0a4f113b:auth:" + ha2)
+	auth = fmt.Sprintf(`Digest username="alice", realm="%s", nonce="%s", uri="/", qop=auth, nc=00000002, cnonce="0a4f113b", response="%s"`, f.Realm, nonce, response)
+	req, _ := http.NewRequest("GET", "http://www.example.com/other", nil)
+	req.Header.Set("Proxy-Authorization", auth)
+	rw = httptest.NewRecorder()
+	if _, req, _ := f.Request(&filters.Context{"__responsewriter__": rw}, req); req != nil {
+		t.Errorf("digest for another uri accepted")
+	}
+	if _, req := doRequest(f, "GET", auth); req == nil {
+		t.Errorf("valid digest with the next count rejected")
+	}
+
+	// CONNECT responses are for the authority
+	ha2 = md5hex("CONNECT:www.example.com:443")
+	response = md5hex(ha1 + ":" + nonce + ":00000003:0a4f113b:auth:" + ha2)
+	auth = fmt.Sprintf(`Digest username="alice", realm="%s", nonce="%s", uri="www.example.com:443", qop=auth, nc=00000003, cnonce="0a4f113b", response="%s"`, f.Realm, nonce, response)
+	if _, req := doRequest(f, "CONNECT", auth); req == nil {
+		t.Errorf("valid CONNECT digest rejected")
+	}
+}
+
+func TestNonceCountExpires(t *testing.T) {
+	f := newTestFilter(t)
+	old := fmt.Sprintf("%x:stale", time.Now().Add(-2*NonceExpires).Unix())
+	if !f.useNonceCount(old, "00000001") {
+		t.Fatalf("useNonceCount(%q) = false", old)
+	}
+	if _, ok := f.ncs[old]; ok {
+		t.Errorf("expired nonce %q kept", old)
+	}
+
+	// the counts are purged once every NonceExpires
+	f.ncs[old] = nonceCount{1, time.Now().Add(-NonceExpires)}
+	nonce := f.newNonce()
+	if !f.useNonceCount(nonce, "00000001") {
+		t.Fatalf("useNonceCount(%q) = false", nonce)
+	}
+	if _, ok := f.ncs[old]; !ok {
+		t.Errorf("nonce %q purged before NonceExpires", old)
+	}
+	f.purged = time.Now().Add(-2 * NonceExpires)
+	if !f.useNonceCount(nonce, "00000002") {
+		t.Fatalf("useNonceCount(%q, 2) = false", nonce)
+	}
+	if _, ok := f.ncs[old]; ok || f.ncs[nonce].nc != 2 {
+		t.Errorf("ncs = %v, want only %q at 2", f.ncs, nonce)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatalf("ioutil.TempFile error: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	// bob:{SHA}secret, carol:GoAgent:md5(carol:GoAgent:secret), erin and
+	// frank from openssl passwd -apr1 and -1
+	fmt.Fprintf(file, "# users\nalice:secret\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\ncarol:GoAgent:%s\ndave:Other:%s\n",
+		md5hex("carol:GoAgent:secret"), md5hex("dave:Other:secret"))
+	fmt.Fprintf(file, "erin:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\nfrank:$1$saltsalt$9xy1btjgzLYfb7hivXtC//\n")
+	file.Close()
+
+	f := newTestFilter(t)
+	if err := f.LoadFile(file.Name()); err != nil {
+		t.Fatalf("LoadFile error: %s", err)
+	}
+	for _, user := range []string{"alice", "bob", "carol", "erin", "frank"} {
+		if !f.CheckPassword(user, "secret") {
+			t.Errorf("CheckPassword(%#v) failed", user)
+		}
+		if f.CheckPassword(user, "wrong") {
+			t.Errorf("CheckPassword(%#v) accepted a wrong password", user)
+		}
+	}
+	if f.CheckPassword("dave", "secret") {
+		t.Errorf("CheckPassword(\"dave\") accepted a user of another realm")
+	}
+	if f.CheckPassword("erin", "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/") {
+		t.Errorf("CheckPassword(\"erin\") accepted the hash as a password")
+	}
+
+	// unknown hashes are not taken for passwords
+	file, err = ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatalf("ioutil.TempFile error: %s", err)
+	}
+	defer os.Remove(file.Name())
+	fmt.Fprintf(file, "alice:$6$saltsalt$hash\n")
+	file.Close()
+	if err := newTestFilter(t).LoadFile(file.Name()); err == nil {
+		t.Errorf("LoadFile accepted a sha512-crypt hash")
+	}
+}
+
+func TestMD5Crypt(t *testing.T) {
+	// openssl passwd -apr1 -salt xy ''
+	if h := md5Crypt("", "xy", "$apr1$"); h != "$apr1$xy$43..WIhbfuznGvwoCyUek/" {
+		t.Errorf("md5Crypt = %s", h)
+	}
+}
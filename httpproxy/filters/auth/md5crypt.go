@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/md5"
+	"strings"
+)
+
+const md5CryptItoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// md5Crypt returns the MD5-crypt hash of password, magic is "$apr1$" for the
+// htpasswd default and "$1$" for crypt(3). salt is the hash to check against
+// or its salt.
+func md5Crypt(password, salt, magic string) string {
+	salt = strings.TrimPrefix(salt, magic)
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(password); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write([]byte(password[:1]))
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write([]byte(password))
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write([]byte(password))
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write([]byte(password))
+		}
+		final = h.Sum(nil)
+	}
+
+	b := make([]byte, 0, 22)
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			b = append(b, md5CryptItoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[i[0]])<<16|uint(final[i[1]])<<8|uint(final[i[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return magic + salt + "$" + string(b)
+}
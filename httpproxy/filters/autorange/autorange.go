@@ -0,0 +1,167 @@
+package autorange
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"github.com/phuslu/goproxy/httpproxy/ranges"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// rangeRetry is how many times a failed range is fetched again.
+const rangeRetry = 2
+
+// Filter downloads large files of matching urls as concurrent range requests
+// through Backend, and reassembles them in order. Responses of servers which
+// ignore Range are passed through.
+type Filter struct {
+	filters.RoundTripFilter
+	Backend filters.RoundTripFilter
+	// Hosts are wildcards of the hosts to download by ranges.
+	Hosts []string
+	// Endswith and Noendswith are suffixes of the url paths to download, or
+	// not to download, by ranges whatever the host.
+	Endswith   []string
+	Noendswith []string
+	// Threads is the number of ranges fetched at the same time, at most
+	// Threads ranges are buffered ahead of the client.
+	Threads int
+	// MaxSize is the size of a range.
+	MaxSize int64
+	// WaitSize is the size of the first range, which is streamed to the client
+	// while the following ranges are fetched.
+	WaitSize int64
+	// BufSize is the size of the reads from the backend.
+	BufSize int
+}
+
+func init() {
+	filters.Register("autorange", &filters.RegisteredFilter{
+		New: NewFilter,
+	})
+}
+
+func NewFilter() (filters.Filter, error) {
+	return &Filter{
+		Threads:  2,
+		MaxSize:  1 << 20,
+		WaitSize: 512 << 10,
+		BufSize:  8 << 10,
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return "autorange"
+}
+
+func (f *Filter) match(req *http.Request) bool {
+	if req.Method != "GET" || req.Header.Get("Range") != "" {
+		return false
+	}
+	p := strings.ToLower(req.URL.Path)
+	// an empty suffix, as read from an empty option, matches nothing
+	for _, suffix := range f.Noendswith {
+		if suffix != "" && strings.HasSuffix(p, suffix) {
+			return false
+		}
+	}
+	for _, suffix := range f.Endswith {
+		if suffix != "" && strings.HasSuffix(p, suffix) {
+			return true
+		}
+	}
+	host := req.URL.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range f.Hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	if !f.match(req) {
+		return f.Backend.RoundTrip(ctx, req)
+	}
+
+	ctx, resp, err := f.Backend.RoundTrip(ctx, ranges.Request(req, 0, f.WaitSize-1))
+	if err != nil || resp == nil || resp.StatusCode != http.StatusPartialContent {
+		// the server ignores Range or fails, pass it through
+		return ctx, resp, err
+	}
+	start, end, total, ok := ranges.ParseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || start != 0 {
+		resp.Body.Close()
+		return ctx, nil, fmt.Errorf("AUTORANGE %s return Content-Range %q", req.URL.String(), resp.Header.Get("Content-Range"))
+	}
+
+	// the following ranges must be of the same body
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+
+	ranges.Complete(resp, total)
+	if end+1 == total {
+		return ctx, resp, nil
+	}
+	glog.Infof("AUTORANGE %s %d bytes by %d threads", req.URL.String(), total, f.Threads)
+
+	// ranges are sent on copies, as the handler goes on with ctx
+	ctx1 := make(filters.Context)
+	for key, value := range *ctx {
+		ctx1[key] = value
+	}
+	resp.Body = ranges.NewReader(resp.Body, end+1, total, f.MaxSize, f.Threads, func(start, end int64) ([]byte, error) {
+		var b []byte
+		var err error
+		for i := 0; i <= rangeRetry; i++ {
+			if b, err = f.fetchRange(&ctx1, req, start, end, etag, lastModified); err == nil {
+				break
+			}
+			glog.Warningf("AUTORANGE %s range %d-%d error: %v", req.URL.String(), start, end, err)
+		}
+		return b, err
+	})
+	return ctx, resp, nil
+}
+
+// fetchRange fetches the bytes start-end of the body whose validators are
+// etag and lastModified. A changed body fails, rather than be spliced in.
+func (f *Filter) fetchRange(ctx *filters.Context, req *http.Request, start, end int64, etag, lastModified string) ([]byte, error) {
+	req1 := ranges.Request(req, start, end)
+	// a server honoring If-Range answers a changed body by a 200, which
+	// ReadRange refuses
+	switch {
+	case etag != "" && !strings.HasPrefix(etag, "W/"):
+		req1.Header.Set("If-Range", etag)
+	case lastModified != "":
+		req1.Header.Set("If-Range", lastModified)
+	}
+	_, resp, err := f.Backend.RoundTrip(ctx, req1)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("AUTORANGE %s range %d-%d no response", req.URL.String(), start, end)
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		if etag1 := resp.Header.Get("ETag"); etag != "" && etag1 != etag {
+			resp.Body.Close()
+			return nil, fmt.Errorf("AUTORANGE %s range %d-%d return ETag %q, want %q", req.URL.String(), start, end, etag1, etag)
+		}
+		if lastModified1 := resp.Header.Get("Last-Modified"); lastModified != "" && lastModified1 != lastModified {
+			resp.Body.Close()
+			return nil, fmt.Errorf("AUTORANGE %s range %d-%d return Last-Modified %q, want %q", req.URL.String(), start, end, lastModified1, lastModified)
+		}
+	}
+	b, err := ranges.ReadRange(resp, start, end, f.BufSize)
+	if err != nil {
+		return nil, fmt.Errorf("AUTORANGE %s %v", req.URL.String(), err)
+	}
+	return b, nil
+}
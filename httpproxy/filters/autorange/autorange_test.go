@@ -0,0 +1,207 @@
+package autorange
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// backend serves content, honoring Range unless ignoreRange is set. A
+// backend with an etag honors If-Range too.
+type backend struct {
+	content     []byte
+	ignoreRange bool
+	etag        string
+
+	mu       sync.Mutex
+	ranges   []string
+	ifRanges []string
+}
+
+func (b *backend) FilterName() string {
+	return "backend"
+}
+
+func (b *backend) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	rng := req.Header.Get("Range")
+	b.mu.Lock()
+	b.ranges = append(b.ranges, rng)
+	ifRange := req.Header.Get("If-Range")
+	if ifRange != "" {
+		b.ifRanges = append(b.ifRanges, ifRange)
+	}
+	content, etag := b.content, b.etag
+	b.mu.Unlock()
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	if etag != "" {
+		resp.Header.Set("ETag", etag)
+	}
+	body := content
+	if rng != "" && !b.ignoreRange && (ifRange == "" || ifRange == etag) {
+		var start, end int
+		fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+		if end >= len(content) {
+			end = len(content) - 1
+		}
+		resp.StatusCode = http.StatusPartialContent
+		resp.Status = "206 Partial Content"
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		body = content[start : end+1]
+	}
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return ctx, resp, nil
+}
+
+func newTestFilter(b *backend) *Filter {
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	f.Backend = b
+	f.Hosts = []string{"*.c.youtube.com"}
+	f.Endswith = []string{".mp4"}
+	f.Noendswith = []string{".html"}
+	f.Threads = 3
+	f.MaxSize = 10
+	f.WaitSize = 5
+	f.BufSize = 4
+	return f
+}
+
+func TestMatch(t *testing.T) {
+	f := newTestFilter(nil)
+	for rawurl, want := range map[string]bool{
+		"http://r1.c.youtube.com/videoplayback":    true,
+		"http://r1.c.youtube.com:80/videoplayback": true,
+		"http://r1.c.youtube.com/index.html":       false,
+		"http://www.example.com/movie.MP4":         true,
+		"http://www.example.com/movie.mp4.html":    false,
+		"http://www.example.com/":                  false,
+	} {
+		req, _ := http.NewRequest("GET", rawurl, nil)
+		if got := f.match(req); got != want {
+			t.Errorf("match(%#v) = %v, want %v", rawurl, got, want)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com/movie.mp4", nil)
+	req.Header.Set("Range", "bytes=0-")
+	if f.match(req) {
+		t.Errorf("match(%#v) with Range = true, want false", req.URL.String())
+	}
+	// the empty options of proxy.ini match nothing
+	f.Endswith = append(f.Endswith, "")
+	f.Noendswith = append(f.Noendswith, "")
+	req, _ = http.NewRequest("GET", "http://www.example.com/", nil)
+	if f.match(req) {
+		t.Errorf("match(%#v) with an empty Endswith = true, want false", req.URL.String())
+	}
+	req, _ = http.NewRequest("GET", "http://www.example.com/movie.mp4", nil)
+	if !f.match(req) {
+		t.Errorf("match(%#v) with an empty Noendswith = false, want true", req.URL.String())
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 3)
+	for _, ignoreRange := range []bool{false, true} {
+		b := &backend{content: content, ignoreRange: ignoreRange}
+		f := newTestFilter(b)
+
+		req, _ := http.NewRequest("GET", "http://www.example.com/movie.mp4", nil)
+		_, resp, err := f.RoundTrip(&filters.Context{}, req)
+		if err != nil {
+			t.Fatalf("RoundTrip error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("ReadAll error: %s", err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(content)) || resp.Header.Get("Content-Range") != "" {
+			t.Errorf("response = %d, Content-Length %d, Content-Range %q", resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Range"))
+		}
+		if !bytes.Equal(body, content) {
+			t.Errorf("body = %q, want %q", body, content)
+		}
+
+		want := 1
+		if !ignoreRange {
+			// a range of WaitSize, then ranges of MaxSize
+			want += (len(content) - 5 + 9) / 10
+		}
+		if len(b.ranges) != want {
+			t.Errorf("ignoreRange=%v: ranges = %q, want %d requests", ignoreRange, b.ranges, want)
+		}
+	}
+}
+
+func TestRoundTripSmall(t *testing.T) {
+	// the first range is the whole content
+	b := &backend{content: []byte("abc")}
+	f := newTestFilter(b)
+	req, _ := http.NewRequest("GET", "http://www.example.com/movie.mp4", nil)
+	_, resp, err := f.RoundTrip(&filters.Context{}, req)
+	if err != nil {
+		t.Fatalf("RoundTrip error: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Range") != "" || string(body) != "abc" {
+		t.Errorf("response = %d, Content-Range %q, %q, want 200 %q", resp.StatusCode, resp.Header.Get("Content-Range"), body, "abc")
+	}
+	if len(b.ranges) != 1 {
+		t.Errorf("ranges = %q, want 1 request", b.ranges)
+	}
+}
+
+func TestRoundTripChanged(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 3)
+	b := &backend{content: content, etag: `"v1"`}
+	f := newTestFilter(b)
+	f.Threads = 1
+
+	req, _ := http.NewRequest("GET", "http://www.example.com/movie.mp4", nil)
+	_, resp, err := f.RoundTrip(&filters.Context{}, req)
+	if err != nil {
+		t.Fatalf("RoundTrip error: %s", err)
+	}
+	defer resp.Body.Close()
+	// the body changes after the first ranges
+	buf := make([]byte, 15)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatalf("ReadFull error: %s", err)
+	}
+	b.mu.Lock()
+	b.content = bytes.ToUpper(content)
+	b.etag = `"v2"`
+	b.mu.Unlock()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("ReadAll of a changed body = %q, want an error", body)
+	}
+	if bytes.Contains(body, []byte("ABC")) {
+		t.Errorf("body %q spliced from the changed content", body)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ifRange := range b.ifRanges {
+		if ifRange != `"v1"` {
+			t.Errorf("If-Range = %q, want %q", ifRange, `"v1"`)
+		}
+	}
+	if len(b.ifRanges) == 0 {
+		t.Errorf("no If-Range sent")
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/phuslu/goproxy/httpproxy/filters"
-	"io"
 	"net"
 	"net/http"
 	"time"
@@ -13,7 +12,10 @@ import (
 
 type Filter struct {
 	filters.RoundTripFilter
-	transport *http.Transport
+	Transport *http.Transport
+	// ProxyTransport, if not nil, sends the plain http requests instead of
+	// Transport, e.g. in absolute form to a parent proxy.
+	ProxyTransport http.RoundTripper
 }
 
 func init() {
@@ -24,7 +26,7 @@ func init() {
 
 func NewFilter() (filters.Filter, error) {
 	return &Filter{
-		transport: &http.Transport{
+		Transport: &http.Transport{
 			Dial: (&net.Dialer{
 				Timeout:   10 * time.Second,
 				KeepAlive: 180 * time.Second,
@@ -50,25 +52,21 @@ func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Co
 			return ctx, nil, fmt.Errorf("DIRECT RoundTrip %#v error: %#v", req, err)
 		}
 		req1.Header = req.Header
-		res, err := f.transport.RoundTrip(req1)
+		var tr http.RoundTripper = f.Transport
+		if f.ProxyTransport != nil {
+			tr = f.ProxyTransport
+		}
+		res, err := tr.RoundTrip(req1)
 		if err == nil {
 			glog.Infof("%s \"DIRECT %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, res.StatusCode, res.Header.Get("Content-Length"))
 		}
 		return ctx, res, err
 	} else {
 		glog.Infof("%s \"DIRECT %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
-		remote, err := f.transport.Dial("tcp", req.Host)
+		remote, err := f.Transport.Dial("tcp", req.Host)
 		if err != nil {
 			return ctx, nil, err
 		}
-		hijacker, ok := ctx.GetResponseWriter().(http.Hijacker)
-		if !ok {
-			return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments Hijacker", ctx.GetResponseWriter())
-		}
-		local, _, err := hijacker.Hijack()
-		local.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
-		go io.Copy(remote, local)
-		io.Copy(local, remote)
-		return ctx, nil, nil
+		return ctx, nil, filters.Tunnel(ctx, remote, remote)
 	}
 }
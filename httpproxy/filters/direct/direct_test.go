@@ -0,0 +1,12 @@
+package direct
+
+import (
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"github.com/phuslu/goproxy/httpproxy/filters/filterstest"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	f, _ := NewFilter()
+	filterstest.CheckProxy(t, f.(filters.RoundTripFilter))
+}
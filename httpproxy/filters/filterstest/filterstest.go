@@ -0,0 +1,83 @@
+// Package filterstest runs RoundTripFilters behind an httpproxy.Handler, for
+// tests of the filters which proxy requests to a remote server.
+package filterstest
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/phuslu/goproxy/httpproxy"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Serve runs an httpproxy.Handler with f on ln.
+func Serve(ln net.Listener, f filters.RoundTripFilter) {
+	h := httpproxy.Handler{
+		Listener:         ln,
+		RoundTripFilters: []filters.RoundTripFilter{f},
+	}
+	go http.Serve(ln, h)
+}
+
+// CheckProxy serves f as an http proxy, and checks that a POST and a CONNECT
+// tunnel through it reach an origin server.
+func CheckProxy(t *testing.T, f filters.RoundTripFilter) {
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		io.WriteString(rw, r.Method+" "+string(b))
+	}))
+	defer origin.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	defer ln.Close()
+	Serve(ln, f)
+
+	proxyURL, _ := url.Parse("http://" + ln.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post(origin.URL+"/", "text/plain", strings.NewReader("a=b"))
+	if err != nil {
+		t.Fatalf("Post error: %s", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "POST a=b" {
+		t.Errorf("response = %d %q, want 200 %q", resp.StatusCode, b, "POST a=b")
+	}
+
+	// CONNECT, then a request through the tunnel
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial error: %s", err)
+	}
+	defer conn.Close()
+	originAddr := strings.TrimPrefix(origin.URL, "http://")
+	// the request through the tunnel is sent along with the CONNECT
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nGET / HTTP/1.1\r\nHost: %s\r\n\r\n", originAddr, originAddr, originAddr)
+	br := bufio.NewReader(conn)
+	req, _ := http.NewRequest("CONNECT", originAddr, nil)
+	resp, err = http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("ReadResponse error: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT response = %d, want 200", resp.StatusCode)
+	}
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse error: %s", err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	if string(b) != "GET " {
+		t.Errorf("tunnel response = %q, want %q", b, "GET ")
+	}
+}
@@ -0,0 +1,90 @@
+package gae
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// appIDPenalty is how long an appid is skipped after a failed request.
+	appIDPenalty = 1 * time.Minute
+	// appIDMaxRetry limits the appids tried for one request.
+	appIDMaxRetry = 3
+)
+
+var pacificTime = loadPacificTime()
+
+func loadPacificTime() *time.Location {
+	if loc, err := time.LoadLocation("America/Los_Angeles"); err == nil {
+		return loc
+	}
+	return time.FixedZone("PST", -8*3600)
+}
+
+// quotaReset returns the next midnight of Pacific time, when the daily
+// quotas of appengine are reset.
+func quotaReset(now time.Time) time.Time {
+	t := now.In(pacificTime)
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, pacificTime)
+}
+
+// appIDPool hands out appids round-robin, skipping the blacklisted ones.
+// When all of them are blacklisted the one to be released first is used.
+type appIDPool struct {
+	mu        sync.Mutex
+	next      int
+	blacklist map[string]time.Time
+	versions  map[string]int
+}
+
+func (p *appIDPool) pick(appids []string, tried map[string]bool) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var fallback string
+	var fallbackUntil time.Time
+	for i := 0; i < len(appids); i++ {
+		appid := appids[(p.next+i)%len(appids)]
+		if tried[appid] {
+			continue
+		}
+		until, ok := p.blacklist[appid]
+		if !ok || now.After(until) {
+			p.next = (p.next + i + 1) % len(appids)
+			return appid
+		}
+		if fallback == "" || until.Before(fallbackUntil) {
+			fallback, fallbackUntil = appid, until
+		}
+	}
+	return fallback
+}
+
+func (p *appIDPool) block(appid string, until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.blacklist == nil {
+		p.blacklist = make(map[string]time.Time)
+	}
+	if until.After(p.blacklist[appid]) {
+		p.blacklist[appid] = until
+	}
+}
+
+// version returns the protocol version of the fetchserver of appid, 0 if it
+// is not known yet.
+func (p *appIDPool) version(appid string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.versions[appid]
+}
+
+func (p *appIDPool) setVersion(appid string, version int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.versions == nil {
+		p.versions = make(map[string]int)
+	}
+	p.versions[appid] = version
+}
@@ -0,0 +1,59 @@
+package gae
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppIDPoolRoundRobin(t *testing.T) {
+	var p appIDPool
+	appids := []string{"a", "b", "c"}
+	var got string
+	for i := 0; i < 4; i++ {
+		got += p.pick(appids, nil)
+	}
+	if got != "abca" {
+		t.Errorf("picks = %#v, want %#v", got, "abca")
+	}
+
+	p.block("b", time.Now().Add(time.Hour))
+	got = ""
+	for i := 0; i < 3; i++ {
+		got += p.pick(appids, nil)
+	}
+	if got != "cac" {
+		t.Errorf("picks with b blacklisted = %#v, want %#v", got, "cac")
+	}
+
+	if appid := p.pick(appids, map[string]bool{"a": true, "c": true}); appid != "b" {
+		t.Errorf("pick = %#v, want the blacklisted b as the last resort", appid)
+	}
+}
+
+func TestAppIDPoolFallback(t *testing.T) {
+	var p appIDPool
+	appids := []string{"a", "b"}
+	p.block("a", time.Now().Add(2*time.Hour))
+	p.block("b", time.Now().Add(time.Hour))
+	if appid := p.pick(appids, nil); appid != "b" {
+		t.Errorf("pick = %#v, want the first one to be released", appid)
+	}
+	p.block("b", time.Now().Add(-time.Second))
+	if appid := p.pick(appids, nil); appid != "b" {
+		t.Errorf("pick = %#v, a shorter block must not shorten the blacklist", appid)
+	}
+	if appid := p.pick(appids, map[string]bool{"a": true, "b": true}); appid != "" {
+		t.Errorf("pick = %#v, want none", appid)
+	}
+}
+
+func TestQuotaReset(t *testing.T) {
+	now := time.Date(2015, 3, 1, 7, 59, 0, 0, time.UTC)
+	reset := quotaReset(now).In(pacificTime)
+	if reset.Hour() != 0 || reset.Minute() != 0 || reset.Day() != 1 || !reset.After(now) {
+		t.Errorf("quotaReset(%s) = %s", now, reset)
+	}
+	if d := reset.Sub(now); d <= 0 || d > 24*time.Hour {
+		t.Errorf("quotaReset(%s) is %s later", now, d)
+	}
+}
@@ -6,16 +6,22 @@ import (
 	"compress/gzip"
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/phuslu/goproxy/fetchserver"
 	"github.com/phuslu/goproxy/httpproxy/filters"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 )
 
 const (
 	appspotDomain string = "appspot.com"
 	goagentPath   string = "/_gh/"
+	// maxBodySize is the size of the largest request body appengine takes,
+	// the bodies are buffered up to it for the retries.
+	maxBodySize int64 = 32 * 1024 * 1024
 )
 
 var reqWriteExcludeHeader = map[string]bool{
@@ -31,25 +37,63 @@ var reqWriteExcludeHeader = map[string]bool{
 }
 
 type Filter struct {
-	AppIDs []string
-	Scheme string
+	AppIDs   []string
+	Scheme   string
+	Path     string
+	Password string
+	// Deadline, Validate, MaxSize and FetchMax, the count of fetches tried
+	// by the fetchserver, are passed to the fetchserver, which uses its own
+	// defaults for the zero values.
+	Deadline time.Duration
+	Validate bool
+	MaxSize  int
+	FetchMax int
+	// Obfuscate seals requests and responses in an envelope keyed from
+	// Password, for the fetchservers which support it.
+	Obfuscate bool
+	// Transport, if not nil, is used instead of the transport of Handler.
+	Transport *http.Transport
+	appids    appIDPool
 }
 
-func (f *Filter) pickAppID() string {
-	return f.AppIDs[0]
+func init() {
+	filters.Register("gae", &filters.RegisteredFilter{
+		New: NewFilter,
+	})
 }
 
-func (f *Filter) encodeRequest(req *http.Request) (*http.Request, error) {
+func NewFilter() (filters.Filter, error) {
+	return &Filter{
+		AppIDs: []string{},
+		Scheme: "https",
+		Path:   goagentPath,
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return "gae"
+}
+
+// pickAppID returns the next usable appid which is not in tried.
+func (f *Filter) pickAppID(tried map[string]bool) string {
+	return f.appids.pick(f.AppIDs, tried)
+}
+
+func (f *Filter) encodeRequest(req *http.Request, appid string, obfuscate bool) (*http.Request, error) {
 	var err error
 	var b bytes.Buffer
 	var w io.Writer
 	var gw *gzip.Writer
+	var ew *fetchserver.EnvelopeWriter
 
-	if req.TransferEncoding == nil || req.ContentLength < 1*1024*1024 {
-		gw = gzip.NewWriter(&b)
+	w = &b
+	if obfuscate {
+		ew = fetchserver.NewEnvelopeWriter(&b, f.Password)
+		w = ew
+	}
+	if obfuscate || req.TransferEncoding == nil || req.ContentLength < 1*1024*1024 {
+		gw = gzip.NewWriter(w)
 		w = gw
-	} else {
-		w = &b
 	}
 
 	_, err = fmt.Fprintf(w, "%s %s %s\r\n", req.Method, req.URL.String(), "HTTP/1.1")
@@ -60,6 +104,13 @@ func (f *Filter) encodeRequest(req *http.Request) (*http.Request, error) {
 	if err != nil {
 		return nil, err
 	}
+	if req.ContentLength > 0 && req.Header.Get("Content-Length") == "" {
+		// the fetchserver reads the body by its length
+		_, err = fmt.Fprintf(w, "Content-Length: %d\r\n", req.ContentLength)
+		if err != nil {
+			return nil, err
+		}
+	}
 	_, err = io.WriteString(w, "\r\n")
 	if err != nil {
 		return nil, err
@@ -67,23 +118,36 @@ func (f *Filter) encodeRequest(req *http.Request) (*http.Request, error) {
 
 	var bodyReader io.Reader
 	if gw != nil {
-		_, err = io.Copy(w, req.Body)
-		if err != nil {
-			return nil, err
+		if req.Body != nil {
+			_, err = io.Copy(w, req.Body)
+			if err != nil {
+				return nil, err
+			}
 		}
-		err = gw.Flush()
+		err = gw.Close()
 		if err != nil {
 			return nil, err
 		}
+		if ew != nil {
+			err = ew.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
 		bodyReader = &b
 	} else {
 		bodyReader = io.MultiReader(&b, req.Body)
 	}
+	contentLength := int64(b.Len())
+	if gw == nil {
+		// the body is sent as is after the header
+		contentLength += req.ContentLength
+	}
 
 	u := &url.URL{
 		Scheme: f.Scheme,
-		Host:   fmt.Sprintf("%s.%s", f.pickAppID(), appspotDomain),
-		Path:   goagentPath,
+		Host:   fmt.Sprintf("%s.%s", appid, appspotDomain),
+		Path:   f.Path,
 	}
 	if gw != nil {
 		u.Path += "gzip"
@@ -95,7 +159,7 @@ func (f *Filter) encodeRequest(req *http.Request) (*http.Request, error) {
 		Method:        "POST",
 		URL:           u,
 		Host:          u.Host,
-		ContentLength: int64(b.Len()),
+		ContentLength: contentLength,
 		Body:          ioutil.NopCloser(bodyReader),
 		Header: http.Header{
 			"User-Agent": []string{"B"},
@@ -104,6 +168,26 @@ func (f *Filter) encodeRequest(req *http.Request) (*http.Request, error) {
 	if gw != nil {
 		req1.Header.Set("X-Content-Encoding", "gzip")
 	}
+	if obfuscate {
+		req1.Header.Set("X-Fetch-Version", fetchserver.ProtocolVersion)
+	}
+	if f.Password != "" {
+		if err := f.signRequest(req1, req); err != nil {
+			return nil, err
+		}
+	}
+	if f.Deadline > 0 {
+		req1.Header.Set("X-Fetch-Deadline", strconv.Itoa(int(f.Deadline/time.Second)))
+	}
+	if f.Validate {
+		req1.Header.Set("X-Fetch-Validate", "1")
+	}
+	if f.MaxSize > 0 {
+		req1.Header.Set("X-Fetch-Maxsize", strconv.Itoa(f.MaxSize))
+	}
+	if f.FetchMax > 0 {
+		req1.Header.Set("X-Fetch-Fetchmax", strconv.Itoa(f.FetchMax))
+	}
 	return req1, nil
 }
 
@@ -111,32 +195,131 @@ func (f *Filter) decodeResponse(res *http.Response) (*http.Response, error) {
 	if res.StatusCode != 200 {
 		return res, nil
 	}
-	var err error
-	var resp *http.Response
+	var r io.Reader = res.Body
+	if res.Request != nil && res.Request.Header.Get("X-Fetch-Version") != "" {
+		r = fetchserver.NewEnvelopeReader(r, f.Password)
+	}
 	if "gzip" == res.Header.Get("X-Content-Encoding") {
-		r, err := gzip.NewReader(res.Body)
+		gr, err := gzip.NewReader(r)
 		if err != nil {
+			res.Body.Close()
 			return nil, err
 		}
-		resp, err = http.ReadResponse(bufio.NewReader(r), res.Request)
-	} else {
-		resp, err = http.ReadResponse(bufio.NewReader(ioutil.NopCloser(res.Body)), res.Request)
+		r = gr
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(r), res.Request)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{resp.Body, res.Body}
+	return resp, nil
+}
+
+// roundTrip sends req to appid. An enveloped request is sent again in plain
+// if the fetchserver of appid turns out to predate obfuscation.
+func (f *Filter) roundTrip(tr *http.Transport, req *http.Request, body []byte, appid string) (*http.Response, error) {
+	obfuscate := f.Obfuscate && f.appids.version(appid) != 1
+	for {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req1, err := f.encodeRequest(req, appid, obfuscate)
+		if err != nil {
+			return nil, fmt.Errorf("GAE encodeRequest: %s", err.Error())
+		}
+		res, err := tr.RoundTrip(req1)
+		if err != nil {
+			return nil, err
+		}
+		version, _ := strconv.Atoi(res.Header.Get("X-Fetch-Version"))
+		switch {
+		case res.StatusCode == http.StatusOK:
+			if version == 0 {
+				version = 1
+			}
+			f.appids.setVersion(appid, version)
+		case obfuscate && res.StatusCode == http.StatusInternalServerError && version == 0:
+			// old fetchservers fail to parse the envelope
+			res.Body.Close()
+			glog.Warningf("GAE %s fetchserver does not support obfuscate, fall back to plain", appid)
+			f.appids.setVersion(appid, 1)
+			obfuscate = false
+			continue
+		}
+		return res, nil
 	}
-	return resp, err
 }
 
 func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
-	req1, err := f.encodeRequest(req)
-	if err != nil {
-		return ctx, nil, fmt.Errorf("GAE encodeRequest: %s", err.Error())
+	if f.Obfuscate && f.Password == "" {
+		// the envelope key would be derived from the empty password
+		return ctx, nil, fmt.Errorf("GAE %s %s: obfuscate needs a password", req.Method, req.URL.String())
+	}
+	if req.ContentLength > maxBodySize {
+		return ctx, nil, fmt.Errorf("GAE %s %s: request body of %d bytes is over the limit of %d", req.Method, req.URL.String(), req.ContentLength, maxBodySize)
 	}
-	req1.Header = req.Header
-	res, err := ctx.GetTransport().RoundTrip(req1)
+	// the body is kept to retry the request on another appid
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodySize+1))
+		req.Body.Close()
+		if err != nil {
+			return ctx, nil, err
+		}
+		if int64(len(b)) > maxBodySize {
+			return ctx, nil, fmt.Errorf("GAE %s %s: request body is over the limit of %d bytes", req.Method, req.URL.String(), maxBodySize)
+		}
+		body = b
+	}
+
+	tr := f.Transport
+	if tr == nil {
+		tr = ctx.GetTransport()
+	}
+	resp, err := f.fetch(tr, req, body)
 	if err != nil {
 		return ctx, nil, err
-	} else {
+	}
+	if resp.StatusCode == http.StatusPartialContent && req.Method == "GET" && req.Header.Get("Range") == "" {
+		// the fetchserver fell back to a range on RESPONSE_TOO_LARGE
+		resp = f.completeResponse(tr, req, resp)
+	}
+	return ctx, resp, nil
+}
+
+// fetch sends req with body through the fetchserver, trying another appid on
+// failures.
+func (f *Filter) fetch(tr *http.Transport, req *http.Request, body []byte) (*http.Response, error) {
+	err := fmt.Errorf("GAE %s %s: no appid available", req.Method, req.URL.String())
+	tried := make(map[string]bool)
+	for i := 0; i < appIDMaxRetry && i < len(f.AppIDs); i++ {
+		appid := f.pickAppID(tried)
+		tried[appid] = true
+
+		res, err1 := f.roundTrip(tr, req, body, appid)
+		if err1 != nil {
+			glog.Warningf("GAE %s RoundTrip %s error: %v", appid, req.URL.String(), err1)
+			f.appids.block(appid, time.Now().Add(appIDPenalty))
+			err = err1
+			continue
+		}
+		if res.StatusCode >= http.StatusInternalServerError {
+			res.Body.Close()
+			until := time.Now().Add(appIDPenalty)
+			if res.StatusCode == http.StatusServiceUnavailable {
+				// over quota until the daily reset
+				until = quotaReset(time.Now())
+			}
+			glog.Warningf("GAE %s RoundTrip %s return %d, skip it until %s", appid, req.URL.String(), res.StatusCode, until.Format(time.RFC3339))
+			f.appids.block(appid, until)
+			err = fmt.Errorf("GAE %s RoundTrip %s return %s", appid, req.URL.String(), res.Status)
+			continue
+		}
 		glog.Infof("%s \"GAE %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, res.StatusCode, res.Header.Get("Content-Length"))
+		return f.decodeResponse(res)
 	}
-	resp, err := f.decodeResponse(res)
-	return ctx, resp, err
+	return nil, err
 }
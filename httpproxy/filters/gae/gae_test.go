@@ -0,0 +1,236 @@
+package gae
+
+import (
+	"bufio"
+	"compress/gzip"
+	"github.com/phuslu/goproxy/fetchserver"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTripRetry(t *testing.T) {
+	var hosts []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		if r.URL.Path != "/_gh/gzip" {
+			t.Errorf("path = %s, want /_gh/gzip", r.URL.Path)
+		}
+		if strings.HasPrefix(r.Host, "quota.") {
+			http.Error(rw, "Over Quota", http.StatusServiceUnavailable)
+			return
+		}
+		req, err := readRequest(r)
+		if err != nil {
+			t.Errorf("readRequest error: %s", err)
+			return
+		}
+		io.WriteString(rw, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n"+req.Header.Get("X-Test"))
+	}))
+	defer server.Close()
+
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	f.AppIDs = []string{"quota", "good"}
+	f.Scheme = "http"
+	ctx := &filters.Context{
+		"__transport__": &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial(network, server.Listener.Addr().String())
+			},
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		req.Header.Set("X-Test", "ok")
+		_, resp, err := f.RoundTrip(ctx, req)
+		if err != nil {
+			t.Fatalf("RoundTrip error: %s", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(b) != "ok" {
+			t.Errorf("response = %d %q, want 200 %q", resp.StatusCode, b, "ok")
+		}
+	}
+
+	// the over quota appid is tried once, then skipped
+	want := "quota.appspot.com,good.appspot.com,good.appspot.com"
+	if got := strings.Join(hosts, ","); got != want {
+		t.Errorf("hosts = %s, want %s", got, want)
+	}
+}
+
+func TestRoundTripBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req, err := readRequest(r)
+		if err != nil {
+			t.Errorf("readRequest error: %s", err)
+			return
+		}
+		// the fetchserver reads the body by its length
+		b, _ := ioutil.ReadAll(req.Body)
+		io.WriteString(rw, "HTTP/1.1 200 OK\r\n\r\n"+req.Header.Get("Content-Length")+" "+string(b))
+	}))
+	defer server.Close()
+
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	f.AppIDs = []string{"test"}
+	f.Scheme = "http"
+	ctx := &filters.Context{
+		"__transport__": &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial(network, server.Listener.Addr().String())
+			},
+		},
+	}
+
+	// a chunked request body has no length of its own
+	req, _ := http.NewRequest("POST", "http://www.example.com/", ioutil.NopCloser(strings.NewReader("a=b")))
+	req.ContentLength = -1
+	_, resp, err := f.RoundTrip(ctx, req)
+	if err != nil {
+		t.Fatalf("RoundTrip error: %s", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "3 a=b" {
+		t.Errorf("response = %q, want %q", b, "3 a=b")
+	}
+}
+
+// readRequest reads the request sent by the filter to the fetchserver.
+func readRequest(r *http.Request) (*http.Request, error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("X-Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = gr
+	}
+	return http.ReadRequest(bufio.NewReader(body))
+}
+
+func TestRoundTripLargeBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req, err := readRequest(r)
+		if err != nil {
+			t.Errorf("readRequest error: %s", err)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		io.WriteString(rw, "HTTP/1.1 200 OK\r\n\r\n"+req.Header.Get("Content-Length")+" "+strconv.Itoa(len(b)))
+	}))
+	defer server.Close()
+
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	f.AppIDs = []string{"test"}
+	f.Scheme = "http"
+	ctx := &filters.Context{
+		"__transport__": &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial(network, server.Listener.Addr().String())
+			},
+		},
+	}
+
+	// a chunked body of 1MB or more is sent without gzip
+	const size = 2 << 20
+	req, _ := http.NewRequest("POST", "http://www.example.com/", ioutil.NopCloser(strings.NewReader(strings.Repeat("a", size))))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	_, resp, err := f.RoundTrip(ctx, req)
+	if err != nil {
+		t.Fatalf("RoundTrip error: %s", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := strconv.Itoa(size) + " " + strconv.Itoa(size); string(b) != want {
+		t.Errorf("response = %q, want %q", b, want)
+	}
+}
+
+// errReader fails the reads, for the bodies which must not be read.
+type errReader struct{}
+
+func (errReader) Read(b []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+// zeroReader reads zeros without end.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestRoundTripBodyLimit(t *testing.T) {
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	f.AppIDs = []string{"test"}
+	ctx := &filters.Context{"__transport__": &http.Transport{}}
+
+	// the length is known, the body is not read
+	req, _ := http.NewRequest("POST", "http://www.example.com/", ioutil.NopCloser(errReader{}))
+	req.ContentLength = maxBodySize + 1
+	if _, _, err := f.RoundTrip(ctx, req); err == nil || !strings.Contains(err.Error(), "over the limit") {
+		t.Errorf("RoundTrip of %d bytes error = %v, want over the limit", req.ContentLength, err)
+	}
+
+	// a chunked body is read up to the limit
+	req, _ = http.NewRequest("POST", "http://www.example.com/", ioutil.NopCloser(io.LimitReader(zeroReader{}, maxBodySize+1)))
+	req.ContentLength = -1
+	if _, _, err := f.RoundTrip(ctx, req); err == nil || !strings.Contains(err.Error(), "over the limit") {
+		t.Errorf("RoundTrip of a chunked body over the limit error = %v, want over the limit", err)
+	}
+}
+
+func TestEncodeRequestOptions(t *testing.T) {
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	f.Password = "secret"
+	f.Deadline = 20 * time.Second
+	f.Validate = true
+	f.MaxSize = 1 << 20
+	f.FetchMax = 3
+
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	req.Header.Set("Cookie", "a=b")
+	req1, err := f.encodeRequest(req, "test", false)
+	if err != nil {
+		t.Fatalf("encodeRequest error: %s", err)
+	}
+	timestamp, nonce := req1.Header.Get("X-Fetch-Timestamp"), req1.Header.Get("X-Fetch-Nonce")
+	if nonce == "" {
+		t.Errorf("X-Fetch-Nonce is empty")
+	}
+	if ts, _ := strconv.ParseInt(timestamp, 10, 64); time.Since(time.Unix(ts, 0)) > time.Minute {
+		t.Errorf("X-Fetch-Timestamp = %#v", timestamp)
+	}
+	for key, value := range map[string]string{
+		"X-Fetch-Password":  "",
+		"X-Fetch-Signature": fetchserver.Signature("secret", "GET", "http://www.example.com/", timestamp, nonce),
+		"X-Fetch-Deadline":  "20",
+		"X-Fetch-Validate":  "1",
+		"X-Fetch-Maxsize":   "1048576",
+		"X-Fetch-Fetchmax":  "3",
+		"Cookie":            "",
+	} {
+		if v := req1.Header.Get(key); v != value {
+			t.Errorf("header %s = %#v, want %#v", key, v, value)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package gae
+
+import (
+	"bufio"
+	"compress/gzip"
+	"github.com/phuslu/goproxy/fetchserver"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// obfuscateServer emulates a fetchserver which understands envelopes when
+// version is 2.
+func obfuscateServer(t *testing.T, version int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var rc io.Reader = r.Body
+		enveloped := r.Header.Get("X-Fetch-Version") != ""
+		if enveloped {
+			if version < 2 {
+				http.Error(rw, "panic", http.StatusInternalServerError)
+				return
+			}
+			rc = fetchserver.NewEnvelopeReader(rc, "secret")
+		}
+		gr, err := gzip.NewReader(rc)
+		if err != nil {
+			t.Errorf("gzip.NewReader error: %s", err)
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(gr))
+		if err != nil {
+			t.Errorf("http.ReadRequest error: %s", err)
+			return
+		}
+
+		if version >= 2 {
+			rw.Header().Set("X-Fetch-Version", "2")
+		}
+		var w io.Writer = rw
+		if enveloped {
+			ew := fetchserver.NewEnvelopeWriter(rw, "secret")
+			defer ew.Close()
+			w = ew
+		}
+		io.WriteString(w, "HTTP/1.1 200 OK\r\n\r\n"+req.URL.String())
+	}))
+}
+
+func TestRoundTripObfuscate(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		server := obfuscateServer(t, version)
+		f0, _ := NewFilter()
+		f := f0.(*Filter)
+		f.AppIDs = []string{"test"}
+		f.Scheme = "http"
+		f.Password = "secret"
+		f.Obfuscate = true
+		ctx := &filters.Context{
+			"__transport__": &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial(network, server.Listener.Addr().String())
+				},
+			},
+		}
+
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+			_, resp, err := f.RoundTrip(ctx, req)
+			if err != nil {
+				t.Fatalf("version %d RoundTrip error: %s", version, err)
+			}
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if !strings.HasPrefix(string(b), "http://www.example.com/") {
+				t.Errorf("version %d response = %q", version, b)
+			}
+		}
+		if v := f.appids.version("test"); v != version {
+			t.Errorf("version = %d, want %d", v, version)
+		}
+		server.Close()
+	}
+}
+
+func TestRoundTripObfuscateNoPassword(t *testing.T) {
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	f.AppIDs = []string{"test"}
+	f.Obfuscate = true
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	if _, _, err := f.RoundTrip(&filters.Context{"__transport__": &http.Transport{}}, req); err == nil || !strings.Contains(err.Error(), "password") {
+		t.Errorf("RoundTrip without a password error = %v, want obfuscate needs a password", err)
+	}
+}
@@ -0,0 +1,49 @@
+package gae
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/phuslu/goproxy/httpproxy/ranges"
+	"net/http"
+)
+
+// rangeFetchers limits the follow-up ranges fetched ahead of the reader.
+const rangeFetchers = 3
+
+// completeResponse turns resp, the head of a response urlfetch found too
+// large, into a 200 whose body fetches the rest with range requests, each on
+// its own appid.
+func (f *Filter) completeResponse(tr *http.Transport, req *http.Request, resp *http.Response) *http.Response {
+	start, end, total, ok := ranges.ParseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || start != 0 {
+		return resp
+	}
+	// the client asked for no range
+	ranges.Complete(resp, total)
+	if end+1 == total {
+		return resp
+	}
+	glog.Infof("GAE %s truncated at %d of %d bytes, fetch the rest by ranges", req.URL.String(), end+1, total)
+
+	resp.Body = ranges.NewReader(resp.Body, end+1, total, end+1, rangeFetchers, func(start, end int64) ([]byte, error) {
+		b, err := f.fetchRange(tr, req, start, end)
+		if err != nil {
+			glog.Warningf("GAE %s stitch error: %v", req.URL.String(), err)
+		}
+		return b, err
+	})
+	return resp
+}
+
+// fetchRange fetches the bytes start-end of req.
+func (f *Filter) fetchRange(tr *http.Transport, req *http.Request, start, end int64) ([]byte, error) {
+	resp, err := f.fetch(tr, ranges.Request(req, start, end), nil)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ranges.ReadRange(resp, start, end, 32*1024)
+	if err != nil {
+		return nil, fmt.Errorf("GAE %s %v", req.URL.String(), err)
+	}
+	return b, nil
+}
@@ -0,0 +1,107 @@
+package gae
+
+import (
+	"fmt"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRoundTripStitch(t *testing.T) {
+	const size = 10
+	content := strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz", 3)
+
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req, err := readRequest(r)
+		if err != nil {
+			t.Errorf("readRequest error: %s", err)
+			return
+		}
+		body := content
+		if req.URL.Path == "/small" {
+			body = content[:size]
+		} else {
+			mu.Lock()
+			ranges = append(ranges, req.Header.Get("Range"))
+			mu.Unlock()
+		}
+
+		// emulates the fetchserver on RESPONSE_TOO_LARGE
+		start, end := 0, size-1
+		if rng := req.Header.Get("Range"); rng != "" {
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+		}
+		if end-start+1 > size {
+			end = start + size - 1
+		}
+		if end >= len(body) {
+			end = len(body) - 1
+		}
+		fmt.Fprintf(rw, "HTTP/1.1 206 Partial Content\r\nContent-Range: bytes %d-%d/%d\r\nContent-Length: %d\r\n\r\n%s", start, end, len(body), end-start+1, body[start:end+1])
+	}))
+	defer server.Close()
+
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	f.AppIDs = []string{"a", "b", "c"}
+	f.Scheme = "http"
+	ctx := &filters.Context{
+		"__transport__": &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial(network, server.Listener.Addr().String())
+			},
+		},
+	}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com/large", nil)
+	_, resp, err := f.RoundTrip(ctx, req)
+	if err != nil {
+		t.Fatalf("RoundTrip error: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(content)) || resp.Header.Get("Content-Range") != "" {
+		t.Errorf("response = %d, Content-Length %d, Content-Range %q", resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Range"))
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll error: %s", err)
+	}
+	if string(b) != content {
+		t.Errorf("body = %q, want %q", b, content)
+	}
+	if n := (len(content) + size - 1) / size; len(ranges) != n {
+		t.Errorf("ranges = %q, want %d requests", ranges, n)
+	}
+
+	// a range asked by the client is passed through
+	req, _ = http.NewRequest("GET", "http://www.example.com/large", nil)
+	req.Header.Set("Range", "bytes=5-9")
+	_, resp, err = f.RoundTrip(ctx, req)
+	if err != nil {
+		t.Fatalf("RoundTrip error: %s", err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(b) != content[5:10] {
+		t.Errorf("response = %d %q, want 206 %q", resp.StatusCode, b, content[5:10])
+	}
+
+	// the head is the whole response
+	req, _ = http.NewRequest("GET", "http://www.example.com/small", nil)
+	_, resp, err = f.RoundTrip(ctx, req)
+	if err != nil {
+		t.Fatalf("RoundTrip error: %s", err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Range") != "" || string(b) != content[:size] {
+		t.Errorf("response = %d, Content-Range %q, %q, want 200 %q", resp.StatusCode, resp.Header.Get("Content-Range"), b, content[:size])
+	}
+}
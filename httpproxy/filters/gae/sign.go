@@ -0,0 +1,25 @@
+package gae
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/phuslu/goproxy/fetchserver"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// signRequest sets the X-Fetch-Timestamp, X-Fetch-Nonce and
+// X-Fetch-Signature headers of req1 for the wrapped request req.
+func (f *Filter) signRequest(req1, req *http.Request) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(b)
+	req1.Header.Set("X-Fetch-Timestamp", timestamp)
+	req1.Header.Set("X-Fetch-Nonce", nonce)
+	req1.Header.Set("X-Fetch-Signature", fetchserver.Signature(f.Password, req.Method, req.URL.String(), timestamp, nonce))
+	return nil
+}
@@ -12,7 +12,9 @@ import (
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 )
 
 var (
@@ -75,6 +77,7 @@ func (p *Filter) Response(ctx *filters.Context, resp *http.Response) (*filters.C
 	}
 
 	img, _, err := image.Decode(resp.Body)
+	resp.Body.Close()
 	if err != nil {
 		glog.Errorf("%s decode %#v error: %v", p.FilterName(), resp, err)
 		return ctx, nil, err
@@ -88,7 +91,9 @@ func (p *Filter) Response(ctx *filters.Context, resp *http.Response) (*filters.C
 	}
 
 	resp.Header.Set("Content-Type", "image/webp")
+	resp.Header.Set("Content-Length", strconv.Itoa(b.Len()))
 	resp.ContentLength = int64(b.Len())
+	resp.Body = ioutil.NopCloser(&b)
 
 	return ctx, resp, nil
 }
@@ -0,0 +1,251 @@
+package php
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+var reqWriteExcludeHeader = map[string]bool{
+	"Vary":                true,
+	"Via":                 true,
+	"X-Forwarded-For":     true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Upgrade":             true,
+	"X-Chrome-Variations": true,
+	"Connection":          true,
+	"Cache-Control":       true,
+}
+
+// Filter sends requests to the index.php fetchservers. A request is a 2 bytes
+// length and the deflated request line and headers, followed by the body; the
+// kwargs of index.php are sent as X-URLFETCH-* headers.
+type Filter struct {
+	filters.RoundTripFilter
+	// FetchServers are the urls of index.php, used in turn.
+	FetchServers []*url.URL
+	Password     string
+	// Validate verifies the certificates of the https fetchservers.
+	Validate bool
+	// Crlf sends an empty line ahead of the requests over plain http, which
+	// some firewalls fail to parse.
+	Crlf bool
+	// Dial connects the fetchservers.
+	Dial      func(network, addr string) (net.Conn, error)
+	Transport *http.Transport
+	next      uint32
+}
+
+func init() {
+	filters.Register("php", &filters.RegisteredFilter{
+		New: NewFilter,
+	})
+}
+
+func NewFilter() (filters.Filter, error) {
+	f := &Filter{
+		FetchServers: []*url.URL{},
+		Dial: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 60 * time.Second,
+		}).Dial,
+	}
+	f.Transport = &http.Transport{
+		Dial:                f.dial,
+		DialTLS:             f.dialTLS,
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 4,
+	}
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return "php"
+}
+
+func (f *Filter) dial(network, addr string) (net.Conn, error) {
+	conn, err := f.Dial(network, addr)
+	if err != nil || !f.Crlf {
+		return conn, err
+	}
+	return &crlfConn{Conn: conn}, nil
+}
+
+func (f *Filter) dialTLS(network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := f.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: !f.Validate,
+	})
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// crlfConn writes an empty line before the first request.
+type crlfConn struct {
+	net.Conn
+	written bool
+}
+
+func (c *crlfConn) Write(b []byte) (int, error) {
+	if !c.written {
+		c.written = true
+		if _, err := io.WriteString(c.Conn, "\r\n"); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// pickFetchServer returns the fetchservers in turn.
+func (f *Filter) pickFetchServer() *url.URL {
+	n := atomic.AddUint32(&f.next, 1)
+	return f.FetchServers[int(n-1)%len(f.FetchServers)]
+}
+
+func (f *Filter) encodeRequest(req *http.Request, body []byte, fetchserver *url.URL) (*http.Request, error) {
+	var b bytes.Buffer
+	b.Write([]byte{0, 0})
+	w, err := flate.NewWriter(&b, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(w, "%s %s %s\r\n", req.Method, req.URL.String(), "HTTP/1.1")
+	if err != nil {
+		return nil, err
+	}
+	err = req.Header.WriteSubset(w, reqWriteExcludeHeader)
+	if err != nil {
+		return nil, err
+	}
+	if f.Password != "" {
+		_, err = fmt.Fprintf(w, "X-URLFETCH-password: %s\r\n", f.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	if b.Len()-2 > 0xffff {
+		return nil, fmt.Errorf("headers of %s too large", req.URL.String())
+	}
+	binary.BigEndian.PutUint16(b.Bytes(), uint16(b.Len()-2))
+	b.Write(body)
+
+	req1 := &http.Request{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Method:        "POST",
+		URL:           fetchserver,
+		Host:          fetchserver.Host,
+		ContentLength: int64(b.Len()),
+		Body:          ioutil.NopCloser(&b),
+		Header: http.Header{
+			"User-Agent": []string{"B"},
+		},
+	}
+	return req1, nil
+}
+
+// xorReader undoes the masking of index.php, which xors image/gif contents
+// with the first byte of the password.
+type xorReader struct {
+	r   io.Reader
+	key byte
+}
+
+func (r *xorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= r.key
+	}
+	return n, err
+}
+
+func (f *Filter) decodeResponse(res *http.Response, req *http.Request) (*http.Response, error) {
+	if res.StatusCode != http.StatusOK {
+		// e.g. 403 for a wrong password
+		return res, nil
+	}
+	var r io.Reader = res.Body
+	if res.Header.Get("Content-Type") == "image/gif" && f.Password != "" {
+		r = &xorReader{r, f.Password[0]}
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(r), req)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{resp.Body, res.Body}
+	return resp, nil
+}
+
+func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	if req.Method == "CONNECT" {
+		return ctx, nil, fmt.Errorf("PHP RoundTrip %s: CONNECT is not supported", req.Host)
+	}
+	if len(f.FetchServers) == 0 {
+		return ctx, nil, fmt.Errorf("PHP RoundTrip %s: no fetchserver", req.URL.String())
+	}
+
+	// the body is kept to retry the request on another fetchserver
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return ctx, nil, err
+		}
+		body = b
+	}
+
+	var err error
+	for i := 0; i < len(f.FetchServers); i++ {
+		fetchserver := f.pickFetchServer()
+		req1, err1 := f.encodeRequest(req, body, fetchserver)
+		if err1 != nil {
+			return ctx, nil, fmt.Errorf("PHP encodeRequest: %s", err1.Error())
+		}
+		res, err1 := f.Transport.RoundTrip(req1)
+		if err1 != nil {
+			glog.Warningf("PHP %s RoundTrip %s error: %v", fetchserver.Host, req.URL.String(), err1)
+			err = err1
+			continue
+		}
+		glog.Infof("%s \"PHP %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, res.StatusCode, res.Header.Get("Content-Length"))
+		resp, err := f.decodeResponse(res, req)
+		return ctx, resp, err
+	}
+	return ctx, nil, err
+}
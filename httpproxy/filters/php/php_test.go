@@ -0,0 +1,151 @@
+package php
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// indexPHP emulates fetchserver/php/index.php, answering with the method,
+// url, X-Test header and body of the request it decodes.
+func indexPHP(t *testing.T, password string, hits *int) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		*hits++
+		data, _ := ioutil.ReadAll(r.Body)
+		n := int(binary.BigEndian.Uint16(data))
+		headers, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data[2 : 2+n])))
+		if err != nil {
+			t.Errorf("inflate error: %s", err)
+			return
+		}
+		body := data[2+n:]
+
+		lines := strings.Split(string(headers), "\r\n")
+		requestLine := strings.Split(lines[0], " ")
+		kwargs := make(map[string]string)
+		header := make(http.Header)
+		for _, line := range lines[1:] {
+			pair := strings.SplitN(line, ":", 2)
+			if len(pair) != 2 {
+				continue
+			}
+			key, value := pair[0], strings.TrimSpace(pair[1])
+			if strings.HasPrefix(strings.ToUpper(key), "X-URLFETCH-") {
+				kwargs[strings.ToLower(key[len("X-URLFETCH-"):])] = value
+			} else {
+				header.Set(key, value)
+			}
+		}
+		if password != "" && kwargs["password"] != password {
+			rw.WriteHeader(http.StatusForbidden)
+			io.WriteString(rw, "Wrong Password")
+			return
+		}
+
+		content := fmt.Sprintf("%s %s %s %s", requestLine[0], requestLine[1], header.Get("X-Test"), body)
+		response := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(content), content)
+		rw.Header().Set("Content-Type", "image/gif")
+		b := []byte(response)
+		for i := range b {
+			b[i] ^= password[0]
+		}
+		rw.Write(b)
+	})
+}
+
+func TestRoundTrip(t *testing.T) {
+	var hits1, hits2 int
+	server1 := httptest.NewServer(indexPHP(t, "123456", &hits1))
+	defer server1.Close()
+	server2 := httptest.NewServer(indexPHP(t, "123456", &hits2))
+	defer server2.Close()
+
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	f.Password = "123456"
+	for _, rawurl := range []string{server1.URL + "/index.php", server2.URL + "/index.php"} {
+		u, _ := url.Parse(rawurl)
+		f.FetchServers = append(f.FetchServers, u)
+	}
+
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("POST", "http://www.example.com/post", strings.NewReader("a=b"))
+		req.Header.Set("X-Test", "ok")
+		_, resp, err := f.RoundTrip(&filters.Context{}, req)
+		if err != nil {
+			t.Fatalf("RoundTrip error: %s", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		want := "POST http://www.example.com/post ok a=b"
+		if resp.StatusCode != http.StatusOK || string(b) != want {
+			t.Errorf("response = %d %q, want 200 %q", resp.StatusCode, b, want)
+		}
+	}
+	if hits1 != 2 || hits2 != 2 {
+		t.Errorf("hits = %d, %d, want 2, 2", hits1, hits2)
+	}
+
+	f.Password = "wrong"
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	_, resp, err := f.RoundTrip(&filters.Context{}, req)
+	if err != nil {
+		t.Fatalf("RoundTrip error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("wrong password: response = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestCrlf(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		line, _ := br.ReadString('\n')
+		if line != "\r\n" {
+			t.Errorf("first line = %q, want an empty line", line)
+		}
+		if _, err := http.ReadRequest(br); err != nil {
+			t.Errorf("http.ReadRequest error: %s", err)
+		}
+		inner := "HTTP/1.1 204 No Content\r\n\r\n"
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s", len(inner), inner)
+	}()
+
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	f.Crlf = true
+	u, _ := url.Parse("http://" + ln.Addr().String() + "/")
+	f.FetchServers = []*url.URL{u}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	_, resp, err := f.RoundTrip(&filters.Context{}, req)
+	if err != nil {
+		t.Fatalf("RoundTrip error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("response = %d, want 204", resp.StatusCode)
+	}
+}
@@ -0,0 +1,172 @@
+package route
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	ruleExact int = iota
+	ruleSuffix
+	ruleWildcard
+	ruleRegexp
+)
+
+type rule struct {
+	kind    int
+	pattern string
+	port    string
+	re      *regexp.Regexp
+	backend string
+}
+
+type Filter struct {
+	filters.RoundTripFilter
+	Default  string
+	rules    []rule
+	backends map[string]filters.RoundTripFilter
+}
+
+func init() {
+	filters.Register("route", &filters.RegisteredFilter{
+		New: NewFilter,
+	})
+}
+
+func NewFilter() (filters.Filter, error) {
+	return &Filter{
+		Default:  "direct",
+		rules:    make([]rule, 0),
+		backends: make(map[string]filters.RoundTripFilter),
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return "route"
+}
+
+// SetBackend registers the RoundTripFilter used for requests routed to name.
+func (f *Filter) SetBackend(name string, backend filters.RoundTripFilter) {
+	f.backends[name] = backend
+}
+
+// AddRule routes requests matching pattern to backend. A pattern containing a
+// backslash is a regexp matched against the full url, a pattern containing
+// '*' or '?' is a wildcard matched against the host, a pattern starting with
+// '.' matches the host suffix and anything else matches the host exactly.
+// Host patterns may carry a ":port" suffix.
+func (f *Filter) AddRule(pattern string, backend string) error {
+	r := rule{
+		pattern: pattern,
+		backend: backend,
+	}
+	switch {
+	case strings.Contains(pattern, "\\"):
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("route: invalid pattern %#v: %s", pattern, err)
+		}
+		r.kind = ruleRegexp
+		r.re = re
+	default:
+		if host, port, err := net.SplitHostPort(pattern); err == nil {
+			r.pattern = host
+			r.port = port
+		}
+		r.pattern = strings.ToLower(r.pattern)
+		switch {
+		case strings.ContainsAny(r.pattern, "*?"):
+			if _, err := path.Match(r.pattern, ""); err != nil {
+				return fmt.Errorf("route: invalid pattern %#v: %s", pattern, err)
+			}
+			r.kind = ruleWildcard
+		case strings.HasPrefix(r.pattern, "."):
+			r.kind = ruleSuffix
+		default:
+			r.kind = ruleExact
+		}
+	}
+	f.rules = append(f.rules, r)
+	sort.Stable(byPriority(f.rules))
+	return nil
+}
+
+type byPriority []rule
+
+func (s byPriority) Len() int      { return len(s) }
+func (s byPriority) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPriority) Less(i, j int) bool {
+	if s[i].kind != s[j].kind {
+		return s[i].kind < s[j].kind
+	}
+	return len(s[i].pattern) > len(s[j].pattern)
+}
+
+func (r *rule) match(host, port, rawurl string) bool {
+	if r.kind == ruleRegexp {
+		return r.re.MatchString(rawurl)
+	}
+	if r.port != "" && r.port != port {
+		return false
+	}
+	switch r.kind {
+	case ruleExact:
+		return host == r.pattern
+	case ruleSuffix:
+		return strings.HasSuffix(host, r.pattern)
+	case ruleWildcard:
+		ok, _ := path.Match(r.pattern, host)
+		return ok
+	}
+	return false
+}
+
+// Route returns the backend name for req.
+func (f *Filter) Route(req *http.Request) string {
+	var host, port, rawurl string
+	if req.Method == "CONNECT" {
+		host = req.Host
+		rawurl = "https://" + req.Host + "/"
+	} else {
+		host = req.URL.Host
+		rawurl = req.URL.String()
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	} else if req.Method != "CONNECT" {
+		switch req.URL.Scheme {
+		case "https":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+	host = strings.ToLower(host)
+
+	for _, r := range f.rules {
+		if r.match(host, port, rawurl) {
+			return r.backend
+		}
+	}
+	return f.Default
+}
+
+func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	name := f.Route(req)
+	(*ctx)["__route__"] = name
+
+	backend, ok := f.backends[name]
+	if !ok {
+		return ctx, nil, fmt.Errorf("ROUTE %s %s: backend %#v not available", req.Method, req.Host, name)
+	}
+	glog.V(2).Infof("%s \"ROUTE %s %s %s\" %s", req.RemoteAddr, req.Method, req.Host, req.Proto, name)
+
+	return backend.RoundTrip(ctx, req)
+}
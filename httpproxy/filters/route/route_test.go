@@ -0,0 +1,55 @@
+package route
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+
+	rules := map[string]string{
+		"www.dropbox.com":                        "gae",
+		".dropbox.com:443":                       "direct",
+		".google.com":                            "gae",
+		"mail.google.com":                        "direct",
+		"*.c.youtube.com":                        "vps",
+		`https?://www\.example\.com/(foo|bar)\?`: "php",
+	}
+	for pattern, backend := range rules {
+		if err := f.AddRule(pattern, backend); err != nil {
+			t.Fatalf("AddRule(%#v) error: %s", pattern, err)
+		}
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		route  string
+	}{
+		{"GET", "http://www.dropbox.com/", "gae"},
+		{"CONNECT", "dl.dropbox.com:443", "direct"},
+		{"GET", "http://dl.dropbox.com/", "direct"},
+		{"GET", "https://dl.dropbox.com/", "direct"},
+		{"GET", "http://www.google.com/", "gae"},
+		{"GET", "https://mail.google.com/mail/", "direct"},
+		{"GET", "http://r1.c.youtube.com/videoplayback", "vps"},
+		{"GET", "http://www.example.com/foo?a=b", "php"},
+		{"GET", "http://www.example.com/baz?a=b", "direct"},
+		{"GET", "http://golang.org/", "direct"},
+	}
+	f.Default = "direct"
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(%#v) error: %s", test.url, err)
+		}
+		if test.method == "CONNECT" {
+			req.Host = test.url
+		}
+		if route := f.Route(req); route != test.route {
+			t.Errorf("Route(%s %s) = %#v, want %#v", test.method, test.url, route, test.route)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package shadowsocks
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"github.com/phuslu/goproxy/netutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Filter sends requests through Shadowsocks servers, the plain http requests
+// over connections to the origin servers and the CONNECT requests as tunnels.
+type Filter struct {
+	filters.RoundTripFilter
+	// Servers are the Shadowsocks servers with the method and the password,
+	// e.g. ss://aes-256-gcm:password@host:port. They are used in turn.
+	Servers []*url.URL
+	// Dial connects the Shadowsocks servers.
+	Dial      func(network, addr string) (net.Conn, error)
+	Transport *http.Transport
+	next      uint32
+}
+
+func init() {
+	filters.Register("shadowsocks", &filters.RegisteredFilter{
+		New: NewFilter,
+	})
+}
+
+func NewFilter() (filters.Filter, error) {
+	f := &Filter{
+		Servers: []*url.URL{},
+		Dial: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 60 * time.Second,
+		}).Dial,
+	}
+	f.Transport = &http.Transport{
+		Dial: f.dial,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: false,
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 4,
+	}
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return "shadowsocks"
+}
+
+// NewCipher returns the cipher of the Shadowsocks server u.
+func NewCipher(u *url.URL) (*netutil.ShadowsocksCipher, error) {
+	if u.User == nil {
+		return nil, fmt.Errorf("shadowsocks server %s has no method", u.Host)
+	}
+	password, _ := u.User.Password()
+	return netutil.NewShadowsocksCipher(u.User.Username(), password)
+}
+
+// dial connects addr through the Shadowsocks servers in turn.
+func (f *Filter) dial(network, addr string) (net.Conn, error) {
+	n := atomic.AddUint32(&f.next, 1)
+	u := f.Servers[int(n-1)%len(f.Servers)]
+	c, err := NewCipher(u)
+	if err != nil {
+		return nil, err
+	}
+	d := &netutil.ShadowsocksDialer{
+		Server:     u.Host,
+		Cipher:     c,
+		DialServer: f.Dial,
+	}
+	return d.Dial(network, addr)
+}
+
+func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	if len(f.Servers) == 0 {
+		return ctx, nil, fmt.Errorf("SHADOWSOCKS RoundTrip %s: no server", req.Host)
+	}
+	if req.Method != "CONNECT" {
+		req1, err := http.NewRequest(req.Method, req.URL.String(), req.Body)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("SHADOWSOCKS RoundTrip %#v error: %#v", req, err)
+		}
+		req1.Header = req.Header
+		req1.ContentLength = req.ContentLength
+		res, err := f.Transport.RoundTrip(req1)
+		if err == nil {
+			glog.Infof("%s \"SHADOWSOCKS %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, res.StatusCode, res.Header.Get("Content-Length"))
+		}
+		return ctx, res, err
+	}
+
+	glog.Infof("%s \"SHADOWSOCKS %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
+	remote, err := f.dial("tcp", req.Host)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, nil, filters.Tunnel(ctx, remote, remote)
+}
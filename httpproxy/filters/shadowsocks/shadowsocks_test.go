@@ -0,0 +1,33 @@
+package shadowsocks
+
+import (
+	"github.com/phuslu/goproxy/httpproxy/filters/filterstest"
+	"github.com/phuslu/goproxy/netutil"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, method := range []string{"chacha20-ietf-poly1305", "aes-256-gcm"} {
+		t.Run(method, func(t *testing.T) {
+			// the Shadowsocks server
+			c, err := netutil.NewShadowsocksCipher(method, "secret")
+			if err != nil {
+				t.Fatalf("NewShadowsocksCipher(%#v) error: %s", method, err)
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen error: %s", err)
+			}
+			defer ln.Close()
+			go netutil.ServeShadowsocks(ln, c, nil)
+
+			f0, _ := NewFilter()
+			f := f0.(*Filter)
+			u, _ := url.Parse("ss://" + method + ":secret@" + ln.Addr().String())
+			f.Servers = []*url.URL{u}
+			filterstest.CheckProxy(t, f)
+		})
+	}
+}
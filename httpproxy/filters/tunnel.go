@@ -0,0 +1,32 @@
+package filters
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Tunnel answers the CONNECT request of ctx with 200 and pipes the hijacked
+// client connection with remote, whose data is read from r, remote itself or
+// a reader buffering it. remote is closed when done.
+func Tunnel(ctx *Context, remote net.Conn, r io.Reader) error {
+	defer remote.Close()
+	hijacker, ok := ctx.GetResponseWriter().(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("http.ResponseWriter(%#v) does not implments Hijacker", ctx.GetResponseWriter())
+	}
+	local, brw, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	// the timeouts of the http.Server stay on the hijacked connection
+	local.SetDeadline(time.Time{})
+	local.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	// the client may have sent more than the request already
+	go io.Copy(remote, brw.Reader)
+	io.Copy(local, r)
+	return nil
+}
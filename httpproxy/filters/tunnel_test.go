@@ -0,0 +1,44 @@
+package filters
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// hijackRecorder hands conn over on Hijack.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (rw *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return rw.conn, bufio.NewReadWriter(bufio.NewReader(rw.conn), bufio.NewWriter(rw.conn)), nil
+}
+
+func TestTunnelDeadline(t *testing.T) {
+	client, local := net.Pipe()
+	defer client.Close()
+	// the timeouts of the http.Server expired on the hijacked connection
+	local.SetDeadline(time.Now())
+	remote, server := net.Pipe()
+	defer server.Close()
+	ctx := &Context{"__responsewriter__": &hijackRecorder{httptest.NewRecorder(), local}}
+	go Tunnel(ctx, remote, remote)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	server.SetDeadline(time.Now().Add(time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("ReadResponse = %v, %v, want 200", res, err)
+	}
+	go client.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(server, b); err != nil || string(b) != "ping" {
+		t.Errorf("ReadFull = %q, %v, want %q", b, err, "ping")
+	}
+}
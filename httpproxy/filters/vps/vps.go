@@ -0,0 +1,179 @@
+package vps
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"github.com/phuslu/goproxy/netutil"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Filter sends requests to remote goproxy instances, which serve them with
+// the direct filter, as to an http proxy over the streams of a
+// netutil.MuxSession on netutil.CipherConn.
+type Filter struct {
+	filters.RoundTripFilter
+	// FetchServers are the addresses of the remote goproxy instances, with
+	// the key as password, e.g. cipher://:key@host:port. They are used in
+	// turn.
+	FetchServers []*url.URL
+	// Dial connects the remote goproxy instances, the connections are
+	// encrypted on top of it.
+	Dial      func(network, addr string) (net.Conn, error)
+	Transport *http.Transport
+	next      uint32
+	mu        sync.Mutex
+	sessions  map[string]*netutil.MuxSession
+}
+
+func init() {
+	filters.Register("vps", &filters.RegisteredFilter{
+		New: NewFilter,
+	})
+}
+
+func NewFilter() (filters.Filter, error) {
+	f := &Filter{
+		FetchServers: []*url.URL{},
+		sessions:     map[string]*netutil.MuxSession{},
+		Dial: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 60 * time.Second,
+		}).Dial,
+	}
+	f.Transport = &http.Transport{
+		Proxy:               f.proxy,
+		Dial:                f.dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 4,
+	}
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return "vps"
+}
+
+// pickFetchServer returns the fetchservers in turn.
+func (f *Filter) pickFetchServer() *url.URL {
+	n := atomic.AddUint32(&f.next, 1)
+	return f.FetchServers[int(n-1)%len(f.FetchServers)]
+}
+
+// fetchServerAddr returns the address of the fetchserver u, on port 80 if
+// u has no port as Transport does for the proxy.
+func fetchServerAddr(u *url.URL) string {
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+	return u.Host
+}
+
+func (f *Filter) proxy(req *http.Request) (*url.URL, error) {
+	u := f.pickFetchServer()
+	return &url.URL{Scheme: "http", Host: fetchServerAddr(u)}, nil
+}
+
+// dial opens a stream to the fetchserver listening on addr.
+func (f *Filter) dial(network, addr string) (net.Conn, error) {
+	s, err := f.session(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// session returns the session to the fetchserver listening on addr, and
+// connects it again if closed.
+func (f *Filter) session(network, addr string) (*netutil.MuxSession, error) {
+	f.mu.Lock()
+	s, ok := f.sessions[addr]
+	f.mu.Unlock()
+	if ok && !s.IsClosed() {
+		return s, nil
+	}
+
+	var u *url.URL
+	for _, u1 := range f.FetchServers {
+		if fetchServerAddr(u1) == addr {
+			u = u1
+			break
+		}
+	}
+	if u == nil {
+		return nil, fmt.Errorf("VPS no fetchserver listening on %s", addr)
+	}
+	var key string
+	if u.User != nil {
+		key, _ = u.User.Password()
+	}
+	// the dial is not under f.mu, not to hold up the other fetchservers
+	conn, err := f.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	s = netutil.MuxClient(netutil.CipherClient(conn, &netutil.CipherConfig{Key: []byte(key)}), nil)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s1, ok := f.sessions[addr]; ok && !s1.IsClosed() {
+		// connected meanwhile
+		s.Close()
+		return s1, nil
+	}
+	f.sessions[addr] = s
+	return s, nil
+}
+
+func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	if len(f.FetchServers) == 0 {
+		return ctx, nil, fmt.Errorf("VPS RoundTrip %s: no fetchserver", req.Host)
+	}
+	if req.Method != "CONNECT" {
+		req1, err := http.NewRequest(req.Method, req.URL.String(), req.Body)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("VPS RoundTrip %#v error: %#v", req, err)
+		}
+		req1.Header = req.Header
+		req1.ContentLength = req.ContentLength
+		res, err := f.Transport.RoundTrip(req1)
+		if err == nil {
+			glog.Infof("%s \"VPS %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, res.StatusCode, res.Header.Get("Content-Length"))
+		}
+		return ctx, res, err
+	}
+
+	u := f.pickFetchServer()
+	remote, err := f.dial("tcp", fetchServerAddr(u))
+	if err != nil {
+		return ctx, nil, err
+	}
+	fmt.Fprintf(remote, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", req.Host, req.Host)
+	br := bufio.NewReader(remote)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		remote.Close()
+		return ctx, nil, err
+	}
+	glog.Infof("%s \"VPS %s %s %s\" %d -", req.RemoteAddr, req.Method, req.Host, req.Proto, res.StatusCode)
+	if res.StatusCode != http.StatusOK {
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{res.Body, remote}
+		return ctx, res, nil
+	}
+	return ctx, nil, filters.Tunnel(ctx, remote, br)
+}
@@ -0,0 +1,121 @@
+package vps
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/phuslu/goproxy/httpproxy"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	_ "github.com/phuslu/goproxy/httpproxy/filters/direct"
+	"github.com/phuslu/goproxy/httpproxy/filters/filterstest"
+	"github.com/phuslu/goproxy/netutil"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	// the remote goproxy
+	ln, err := netutil.ListenCipher("tcp", "127.0.0.1:0", []byte("secret"))
+	if err != nil {
+		t.Fatalf("ListenCipher error: %s", err)
+	}
+	ln = netutil.MuxListener(ln, nil)
+	defer ln.Close()
+	directFilter, _ := filters.NewFilter("direct")
+	filterstest.Serve(ln, directFilter.(filters.RoundTripFilter))
+
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	u, _ := url.Parse("cipher://:secret@" + ln.Addr().String())
+	f.FetchServers = []*url.URL{u}
+	filterstest.CheckProxy(t, f)
+}
+
+func TestTunnelTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	defer origin.Close()
+
+	// the remote goproxy times out the requests as goproxy does
+	remoteLn, err := netutil.ListenCipher("tcp", "127.0.0.1:0", []byte("secret"))
+	if err != nil {
+		t.Fatalf("ListenCipher error: %s", err)
+	}
+	remoteLn = netutil.MuxListener(remoteLn, nil)
+	defer remoteLn.Close()
+	directFilter, _ := filters.NewFilter("direct")
+	s := &http.Server{
+		Handler: httpproxy.Handler{
+			Listener:         remoteLn,
+			RoundTripFilters: []filters.RoundTripFilter{directFilter.(filters.RoundTripFilter)},
+		},
+		ReadTimeout:  100 * time.Millisecond,
+		WriteTimeout: 100 * time.Millisecond,
+	}
+	go s.Serve(remoteLn)
+
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	u, _ := url.Parse("cipher://:secret@" + remoteLn.Addr().String())
+	f.FetchServers = []*url.URL{u}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	defer ln.Close()
+	filterstest.Serve(ln, f)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial error: %s", err)
+	}
+	defer conn.Close()
+	originAddr := strings.TrimPrefix(origin.URL, "http://")
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", originAddr, originAddr)
+	br := bufio.NewReader(conn)
+	req, _ := http.NewRequest("CONNECT", originAddr, nil)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT response = %v, %v, want 200", resp, err)
+	}
+
+	// the tunnel outlives the timeouts of the remote goproxy
+	time.Sleep(300 * time.Millisecond)
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", originAddr)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse error: %s", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != "ok" {
+		t.Errorf("tunnel response = %q, want %q", b, "ok")
+	}
+}
+
+func TestSession(t *testing.T) {
+	f0, _ := NewFilter()
+	f := f0.(*Filter)
+	u, _ := url.Parse("cipher://:secret@www.example.com")
+	f.FetchServers = []*url.URL{u}
+	var dialed string
+	f.Dial = func(network, addr string) (net.Conn, error) {
+		dialed = addr
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+	// Transport adds the port 80 to the fetchservers without a port
+	if _, err := f.session("tcp", "www.example.com:80"); err != nil || dialed != "www.example.com:80" {
+		t.Errorf("session(www.example.com:80) dialed %#v, error %v", dialed, err)
+	}
+	if _, err := f.session("tcp", "www.example.org:80"); err == nil {
+		t.Errorf("session(www.example.org:80) of no fetchserver succeeded")
+	}
+}
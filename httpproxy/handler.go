@@ -1,22 +1,53 @@
 package httpproxy
 
 import (
+	"bufio"
+	"fmt"
 	"github.com/golang/glog"
 	"github.com/phuslu/goproxy/httpproxy/filters"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 )
 
 type Handler struct {
 	http.Handler
 	Listener         net.Listener
+	Transport        *http.Transport
 	RequestFilters   []filters.RequestFilter
 	RoundTripFilters []filters.RoundTripFilter
 	ResponseFilters  []filters.ResponseFilter
 }
 
-func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+// responseWriter notes whether a filter has hijacked the connection, after
+// which no error can be written.
+type responseWriter struct {
+	http.ResponseWriter
+	hijacked bool
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments Hijacker", rw.ResponseWriter)
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err == nil {
+		rw.hijacked = true
+	}
+	return conn, brw, err
+}
+
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (h Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rw := &responseWriter{ResponseWriter: w}
+
 	// Enable transport http proxy
 	if req.Method != "CONNECT" && !req.URL.IsAbs() {
 		if req.TLS != nil {
@@ -37,6 +68,7 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	ctx := &filters.Context{
 		"__listener__":       h.Listener,
 		"__responsewriter__": rw,
+		"__transport__":      h.Transport,
 	}
 
 	// Filter Request
@@ -44,6 +76,9 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		ctx, req, err = f.Request(ctx, req)
 		if err != nil {
 			glog.Infof("ServeHTTP %#v error: %v", f, err)
+			if !rw.hijacked {
+				http.Error(rw, err.Error(), http.StatusBadGateway)
+			}
 			return
 		}
 		if req == nil {
@@ -57,6 +92,9 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		ctx, resp, err = f.RoundTrip(ctx, req)
 		if err != nil {
 			glog.Infof("ServeHTTP %#v error: %v", f, err)
+			if !rw.hijacked {
+				http.Error(rw, err.Error(), http.StatusBadGateway)
+			}
 			return
 		}
 		if resp != nil {
@@ -65,26 +103,41 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if resp == nil {
+		return
+	}
+
 	// Filter Response
 	for _, f := range h.ResponseFilters {
+		ctx1, resp1, err := f.Response(ctx, resp)
 		if err != nil {
 			glog.Infof("ServeHTTP %#v error: %v", f, err)
+			resp.Body.Close()
+			if !rw.hijacked {
+				http.Error(rw, err.Error(), http.StatusBadGateway)
+			}
 			return
 		}
-		if resp == nil {
+		if resp1 == nil {
+			// the filter answered itself
+			resp.Body.Close()
 			return
 		}
+		ctx, resp = ctx1, resp1
 	}
 
-	if resp == nil {
-		return
-	}
+	defer resp.Body.Close()
 
 	for key, values := range resp.Header {
 		for _, value := range values {
 			rw.Header().Add(key, value)
 		}
 	}
+	if resp.ContentLength >= 0 {
+		rw.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	} else {
+		rw.Header().Del("Content-Length")
+	}
 	rw.WriteHeader(resp.StatusCode)
 	io.Copy(rw, resp.Body)
 }
@@ -0,0 +1,282 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/phuslu/goproxy/httpproxy/filters"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fixedFilter struct {
+	body string
+}
+
+func (f *fixedFilter) FilterName() string {
+	return "fixed"
+}
+
+func (f *fixedFilter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		ContentLength: int64(len(f.body)),
+		Body:          ioutil.NopCloser(strings.NewReader(f.body)),
+	}
+	return ctx, resp, nil
+}
+
+type headerFilter struct {
+	value string
+}
+
+func (f *headerFilter) FilterName() string {
+	return "header"
+}
+
+func (f *headerFilter) Response(ctx *filters.Context, resp *http.Response) (*filters.Context, *http.Response, error) {
+	resp.Header.Add("X-Filter", f.value)
+	return ctx, resp, nil
+}
+
+type upperFilter struct{}
+
+func (f *upperFilter) FilterName() string {
+	return "upper"
+}
+
+func (f *upperFilter) Response(ctx *filters.Context, resp *http.Response) (*filters.Context, *http.Response, error) {
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return ctx, nil, err
+	}
+	b = bytes.ToUpper(b)
+	resp1 := &http.Response{
+		StatusCode:    http.StatusCreated,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        resp.Header,
+		ContentLength: int64(len(b)) + 1,
+		Body:          ioutil.NopCloser(bytes.NewReader(append(b, '!'))),
+		Request:       resp.Request,
+	}
+	return ctx, resp1, nil
+}
+
+type hijackFilter struct{}
+
+func (f *hijackFilter) FilterName() string {
+	return "hijack"
+}
+
+func (f *hijackFilter) Response(ctx *filters.Context, resp *http.Response) (*filters.Context, *http.Response, error) {
+	resp.Body.Close()
+	rw := ctx.GetResponseWriter()
+	rw.WriteHeader(http.StatusNoContent)
+	return ctx, nil, nil
+}
+
+type errorFilter struct{}
+
+func (f *errorFilter) FilterName() string {
+	return "error"
+}
+
+func (f *errorFilter) Response(ctx *filters.Context, resp *http.Response) (*filters.Context, *http.Response, error) {
+	return ctx, nil, errors.New("errorFilter failed")
+}
+
+func serve(h Handler) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestHandlerResponseFilters(t *testing.T) {
+	h := Handler{
+		RoundTripFilters: []filters.RoundTripFilter{&fixedFilter{"hello"}},
+		ResponseFilters: []filters.ResponseFilter{
+			&headerFilter{"first"},
+			&upperFilter{},
+			&headerFilter{"second"},
+		},
+	}
+	rw := serve(h)
+	if rw.Code != http.StatusCreated {
+		t.Errorf("Code = %d, want %d", rw.Code, http.StatusCreated)
+	}
+	if body := rw.Body.String(); body != "HELLO!" {
+		t.Errorf("Body = %q, want %q", body, "HELLO!")
+	}
+	if got := rw.HeaderMap["X-Filter"]; len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Errorf("X-Filter = %v, want [first second]", got)
+	}
+	if cl := rw.HeaderMap.Get("Content-Length"); cl != "6" {
+		t.Errorf("Content-Length = %q, want %q", cl, "6")
+	}
+}
+
+func TestHandlerResponseFilterShortCircuit(t *testing.T) {
+	h := Handler{
+		RoundTripFilters: []filters.RoundTripFilter{&fixedFilter{"hello"}},
+		ResponseFilters: []filters.ResponseFilter{
+			&hijackFilter{},
+			&errorFilter{},
+		},
+	}
+	rw := serve(h)
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("Code = %d, want %d", rw.Code, http.StatusNoContent)
+	}
+	if rw.Body.Len() != 0 {
+		t.Errorf("Body = %q, want empty", rw.Body.String())
+	}
+}
+
+func TestHandlerResponseFilterError(t *testing.T) {
+	h := Handler{
+		RoundTripFilters: []filters.RoundTripFilter{&fixedFilter{"hello"}},
+		ResponseFilters: []filters.ResponseFilter{
+			&headerFilter{"first"},
+			&errorFilter{},
+			&headerFilter{"second"},
+		},
+	}
+	rw := serve(h)
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Code = %d, want %d", rw.Code, http.StatusBadGateway)
+	}
+	if !strings.Contains(rw.Body.String(), "errorFilter failed") {
+		t.Errorf("Body = %q, want error message", rw.Body.String())
+	}
+	if got := rw.HeaderMap.Get("X-Filter"); got != "" {
+		t.Errorf("X-Filter = %q, want empty", got)
+	}
+}
+
+type closeBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *closeBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+type bodyFilter struct {
+	body *closeBody
+}
+
+func (f *bodyFilter) FilterName() string {
+	return "body"
+}
+
+func (f *bodyFilter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	return ctx, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: f.body}, nil
+}
+
+func TestHandlerResponseFilterErrorClosesBody(t *testing.T) {
+	body := &closeBody{Reader: strings.NewReader("hello")}
+	h := Handler{
+		RoundTripFilters: []filters.RoundTripFilter{&bodyFilter{body}},
+		ResponseFilters:  []filters.ResponseFilter{&errorFilter{}},
+	}
+	serve(h)
+	if !body.closed {
+		t.Errorf("upstream body is not closed")
+	}
+}
+
+type dropFilter struct{}
+
+func (f *dropFilter) FilterName() string {
+	return "drop"
+}
+
+func (f *dropFilter) Response(ctx *filters.Context, resp *http.Response) (*filters.Context, *http.Response, error) {
+	ctx.GetResponseWriter().WriteHeader(http.StatusNoContent)
+	return ctx, nil, nil
+}
+
+func TestHandlerResponseFilterShortCircuitClosesBody(t *testing.T) {
+	body := &closeBody{Reader: strings.NewReader("hello")}
+	h := Handler{
+		RoundTripFilters: []filters.RoundTripFilter{&bodyFilter{body}},
+		ResponseFilters:  []filters.ResponseFilter{&dropFilter{}},
+	}
+	serve(h)
+	if !body.closed {
+		t.Errorf("upstream body is not closed")
+	}
+}
+
+type requestErrorFilter struct{}
+
+func (f *requestErrorFilter) FilterName() string {
+	return "requesterror"
+}
+
+func (f *requestErrorFilter) Request(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Request, error) {
+	return ctx, nil, errors.New("requestErrorFilter failed")
+}
+
+func TestHandlerRequestFilterError(t *testing.T) {
+	h := Handler{
+		RequestFilters:   []filters.RequestFilter{&requestErrorFilter{}},
+		RoundTripFilters: []filters.RoundTripFilter{&fixedFilter{"hello"}},
+	}
+	rw := serve(h)
+	if rw.Code != http.StatusBadGateway || !strings.Contains(rw.Body.String(), "requestErrorFilter failed") {
+		t.Errorf("response = %d %q, want 502 with the error", rw.Code, rw.Body.String())
+	}
+}
+
+// hijackRecorder is a ResponseRecorder which can be hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (rw *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return rw.conn, bufio.NewReadWriter(bufio.NewReader(rw.conn), bufio.NewWriter(rw.conn)), nil
+}
+
+type hijackErrorFilter struct{}
+
+func (f *hijackErrorFilter) FilterName() string {
+	return "hijackerror"
+}
+
+func (f *hijackErrorFilter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	conn, _, err := ctx.GetResponseWriter().(http.Hijacker).Hijack()
+	if err != nil {
+		return ctx, nil, err
+	}
+	conn.Close()
+	return ctx, nil, errors.New("tunnel failed")
+}
+
+func TestHandlerNoErrorAfterHijack(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	h := Handler{
+		RoundTripFilters: []filters.RoundTripFilter{&hijackErrorFilter{}},
+	}
+	req, _ := http.NewRequest("CONNECT", "www.example.com:443", nil)
+	rw := &hijackRecorder{httptest.NewRecorder(), c1}
+	h.ServeHTTP(rw, req)
+	if rw.Body.Len() != 0 || len(rw.HeaderMap) != 0 {
+		t.Errorf("error written after hijack: %d %q", rw.Code, rw.Body.String())
+	}
+}
@@ -0,0 +1,180 @@
+// Package ranges stitches a response from range requests, for the filters
+// which download large bodies by ranges.
+package ranges
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ParseContentRange parses a "bytes start-end/total" Content-Range.
+func ParseContentRange(s string) (start, end, total int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return
+	}
+	s = s[len("bytes "):]
+	i := strings.IndexByte(s, '-')
+	j := strings.IndexByte(s, '/')
+	if i < 0 || j < i {
+		return
+	}
+	var err error
+	if start, err = strconv.ParseInt(s[:i], 10, 64); err != nil {
+		return
+	}
+	if end, err = strconv.ParseInt(s[i+1:j], 10, 64); err != nil {
+		return
+	}
+	if total, err = strconv.ParseInt(s[j+1:], 10, 64); err != nil {
+		return
+	}
+	return start, end, total, start <= end && end < total
+}
+
+// Request returns a copy of req asking for the bytes start-end.
+func Request(req *http.Request, start, end int64) *http.Request {
+	req1 := new(http.Request)
+	*req1 = *req
+	req1.Header = make(http.Header)
+	for key, values := range req.Header {
+		req1.Header[key] = values
+	}
+	req1.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	return req1
+}
+
+// ReadRange reads the bytes start-end from resp, the response of a Request,
+// with reads of bufSize bytes. The body of resp is closed.
+func ReadRange(resp *http.Response, start, end int64, bufSize int) ([]byte, error) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("range %d-%d return %s", start, end, resp.Status)
+	}
+	if start1, end1, _, ok := ParseContentRange(resp.Header.Get("Content-Range")); !ok || start1 != start || end1 != end {
+		return nil, fmt.Errorf("range %d-%d return Content-Range %q", start, end, resp.Header.Get("Content-Range"))
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, end-start+1))
+	if _, err := io.CopyBuffer(buf, io.LimitReader(resp.Body, end-start+1), make([]byte, bufSize)); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) != end-start+1 {
+		return nil, fmt.Errorf("range %d-%d got %d bytes", start, end, buf.Len())
+	}
+	return buf.Bytes(), nil
+}
+
+// Complete turns resp, the first range of a body of total bytes, into the
+// head of a 200 response.
+func Complete(resp *http.Response, total int64) {
+	resp.StatusCode = http.StatusOK
+	resp.Status = "200 OK"
+	resp.ContentLength = total
+	resp.Header.Set("Content-Length", strconv.FormatInt(total, 10))
+	resp.Header.Del("Content-Range")
+}
+
+type result struct {
+	b   []byte
+	err error
+}
+
+// A Reader reads a first range, then the following ones in order.
+type Reader struct {
+	fetch   func(start, end int64) ([]byte, error)
+	size    int64
+	threads int
+	body    io.ReadCloser
+	next    int64
+	total   int64
+	pending []chan result
+	buf     []byte
+	err     error
+}
+
+// NewReader returns a Reader of a body of total bytes, whose bytes up to next
+// are read from body. Up to threads ranges of size bytes are fetched ahead by
+// fetch, starting at once.
+func NewReader(body io.ReadCloser, next, total, size int64, threads int, fetch func(start, end int64) ([]byte, error)) *Reader {
+	r := &Reader{
+		fetch:   fetch,
+		size:    size,
+		threads: threads,
+		body:    body,
+		next:    next,
+		total:   total,
+	}
+	r.schedule()
+	return r
+}
+
+func (r *Reader) schedule() {
+	for len(r.pending) < r.threads && r.next < r.total {
+		start, end := r.next, r.next+r.size-1
+		if end >= r.total {
+			end = r.total - 1
+		}
+		r.next = end + 1
+		ch := make(chan result, 1)
+		r.pending = append(r.pending, ch)
+		go func() {
+			b, err := r.fetch(start, end)
+			ch <- result{b, err}
+		}()
+	}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.body != nil {
+			n, err := r.body.Read(p)
+			if err == io.EOF {
+				r.body.Close()
+				r.body = nil
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			return n, err
+		}
+		if len(r.buf) > 0 {
+			n := copy(p, r.buf)
+			r.buf = r.buf[n:]
+			return n, nil
+		}
+		if len(r.pending) == 0 {
+			return 0, io.EOF
+		}
+		res := <-r.pending[0]
+		r.pending = r.pending[1:]
+		if res.err != nil {
+			r.err = res.err
+			continue
+		}
+		r.buf = res.b
+		r.schedule()
+	}
+}
+
+// Close stops fetching ranges, the ones in flight are dropped.
+func (r *Reader) Close() error {
+	if r.err == nil {
+		r.err = io.ErrClosedPipe
+	}
+	r.pending = nil
+	r.next = r.total
+	if r.body != nil {
+		err := r.body.Close()
+		r.body = nil
+		return err
+	}
+	return nil
+}
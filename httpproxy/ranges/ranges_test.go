@@ -0,0 +1,24 @@
+package ranges
+
+import (
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	for _, test := range []struct {
+		s                 string
+		start, end, total int64
+		ok                bool
+	}{
+		{"bytes 0-4194303/10485760", 0, 4194303, 10485760, true},
+		{"bytes 100-199/200", 100, 199, 200, true},
+		{"bytes 0-199/*", 0, 0, 0, false},
+		{"bytes 0-200/200", 0, 0, 0, false},
+		{"items 0-1/2", 0, 0, 0, false},
+	} {
+		start, end, total, ok := ParseContentRange(test.s)
+		if ok != test.ok || (ok && (start != test.start || end != test.end || total != test.total)) {
+			t.Errorf("ParseContentRange(%q) = %d, %d, %d, %v", test.s, start, end, total, ok)
+		}
+	}
+}
@@ -1,27 +1,71 @@
 package netutil
 
 import (
+	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 	"io"
-	"io/ioutil"
 	"net"
+	"sync"
 	"time"
 )
 
+// A CipherConn exchanges records sealed with an AEAD. Each end sends a random
+// salt first, the client before the server, and the key of each direction is
+// derived from the shared key and both salts. A record is the sealed 2 bytes
+// length of its payload followed by the sealed payload, the nonces of each
+// direction count the seals from zero.
+
+const (
+	cipherSaltSize       = 32
+	cipherKeySize        = 32
+	cipherMaxPayloadSize = 0x3fff
+)
+
+var errCipherRecord = errors.New("cipher: malformed record")
+
 type CipherConfig struct {
-	Key             []byte
-	NonceSize       int
-	NewCipherStream func(key []byte, iv []byte) (cipher.Stream, error)
-	Rand            io.Reader
+	// Key is the secret shared by both ends.
+	Key []byte
+	// NewAEAD returns the AEAD for a derived key of 32 bytes, it is
+	// chacha20poly1305.New if nil.
+	NewAEAD func(key []byte) (cipher.AEAD, error)
+	Rand    io.Reader
+}
+
+// NewAESGCM returns an AES-GCM AEAD, for CipherConfig.NewAEAD.
+func NewAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
 }
 
 type CipherConn struct {
 	conn     net.Conn
 	config   *CipherConfig
 	isClient bool
-	rs       cipher.Stream
-	ws       cipher.Stream
+
+	handshakeMu  sync.Mutex
+	handshakeErr error
+	handshaked   bool
+
+	readMu    sync.Mutex
+	readAEAD  cipher.AEAD
+	readNonce []byte
+	readBuf   []byte
+	plain     []byte
+
+	writeMu    sync.Mutex
+	writeAEAD  cipher.AEAD
+	writeNonce []byte
+	writeBuf   []byte
 }
 
 func CipherClient(conn net.Conn, config *CipherConfig) *CipherConn {
@@ -36,56 +80,180 @@ func CipherServer(conn net.Conn, config *CipherConfig) *CipherConn {
 	return &CipherConn{
 		conn:     conn,
 		config:   config,
-		isClient: true,
+		isClient: false,
+	}
+}
+
+// DialCipher connects the CipherConn server listening on addr with key, see
+// ListenCipher.
+func DialCipher(network, addr string, key []byte) (net.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
 	}
+	return CipherClient(conn, &CipherConfig{Key: key}), nil
 }
 
-func (c *CipherConn) Handshake() (err error) {
-	var nonce []byte
+func (c *CipherConn) deriveAEAD(salt []byte, info string) (cipher.AEAD, error) {
+	key := make([]byte, cipherKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.config.Key, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	newAEAD := c.config.NewAEAD
+	if newAEAD == nil {
+		newAEAD = chacha20poly1305.New
+	}
+	return newAEAD(key)
+}
+
+// Handshake exchanges the salts and derives the keys, it runs on the first
+// Read or Write if not called.
+func (c *CipherConn) Handshake() error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if c.handshaked {
+		return c.handshakeErr
+	}
+	c.handshaked = true
+	c.handshakeErr = c.handshake()
+	return c.handshakeErr
+}
+
+func (c *CipherConn) handshake() error {
+	r := c.config.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	salt := make([]byte, cipherSaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return err
+	}
+	peerSalt := make([]byte, cipherSaltSize)
 	if c.isClient {
-		// Rand Reader
-		var r io.Reader
-		if c.config.Rand != nil {
-			r = c.config.Rand
-		} else {
-			r = rand.Reader
-		}
-		// Generate IV
-		nonce, err = ioutil.ReadAll(&io.LimitedReader{r, int64(c.config.NonceSize)})
-		if err != nil {
+		if _, err := c.conn.Write(salt); err != nil {
 			return err
 		}
-		// Send IV
-		_, err = c.conn.Write(nonce)
-		if err != nil {
+		if _, err := io.ReadFull(c.conn, peerSalt); err != nil {
 			return err
 		}
 	} else {
-		// Read IV
-		nonce, err = ioutil.ReadAll(&io.LimitedReader{c.conn, int64(c.config.NonceSize)})
-		if err != nil {
+		if _, err := io.ReadFull(c.conn, peerSalt); err != nil {
+			return err
+		}
+		if _, err := c.conn.Write(salt); err != nil {
 			return err
 		}
 	}
-	// Read Stream
-	c.rs, err = c.config.NewCipherStream(c.config.Key, nonce)
+
+	clientSalt, serverSalt := salt, peerSalt
+	if !c.isClient {
+		clientSalt, serverSalt = peerSalt, salt
+	}
+	salts := append(append([]byte{}, clientSalt...), serverSalt...)
+	clientAEAD, err := c.deriveAEAD(salts, "goproxy cipher client")
 	if err != nil {
 		return err
 	}
-	// Write Stream
-	c.ws, err = c.config.NewCipherStream(c.config.Key, nonce)
+	serverAEAD, err := c.deriveAEAD(salts, "goproxy cipher server")
 	if err != nil {
 		return err
 	}
+	if c.isClient {
+		c.writeAEAD, c.readAEAD = clientAEAD, serverAEAD
+	} else {
+		c.writeAEAD, c.readAEAD = serverAEAD, clientAEAD
+	}
+	c.writeNonce = make([]byte, c.writeAEAD.NonceSize())
+	c.readNonce = make([]byte, c.readAEAD.NonceSize())
 	return nil
 }
 
+func incNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
 func (c *CipherConn) Read(b []byte) (n int, err error) {
-	return c.conn.Read(b)
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.plain) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func (c *CipherConn) readRecord() error {
+	overhead := c.readAEAD.Overhead()
+	if cap(c.readBuf) < cipherMaxPayloadSize+overhead {
+		c.readBuf = make([]byte, cipherMaxPayloadSize+overhead)
+	}
+
+	buf := c.readBuf[:2+overhead]
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		return err
+	}
+	if _, err := c.readAEAD.Open(buf[:0], c.readNonce, buf, nil); err != nil {
+		return err
+	}
+	incNonce(c.readNonce)
+	size := int(binary.BigEndian.Uint16(buf))
+	if size == 0 || size > cipherMaxPayloadSize {
+		return errCipherRecord
+	}
+
+	buf = c.readBuf[:size+overhead]
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := c.readAEAD.Open(buf[:0], c.readNonce, buf, nil)
+	if err != nil {
+		return err
+	}
+	incNonce(c.readNonce)
+	c.plain = plain
+	return nil
 }
 
 func (c *CipherConn) Write(b []byte) (n int, err error) {
-	return c.conn.Write(b)
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > cipherMaxPayloadSize {
+			chunk = chunk[:cipherMaxPayloadSize]
+		}
+		buf := append(c.writeBuf[:0], byte(len(chunk)>>8), byte(len(chunk)))
+		buf = c.writeAEAD.Seal(buf[:0], c.writeNonce, buf, nil)
+		incNonce(c.writeNonce)
+		buf = c.writeAEAD.Seal(buf, c.writeNonce, chunk, nil)
+		incNonce(c.writeNonce)
+		c.writeBuf = buf[:0]
+		if _, err := c.conn.Write(buf); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
 }
 
 func (c *CipherConn) Close() error {
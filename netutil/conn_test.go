@@ -0,0 +1,88 @@
+package netutil
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// recordConn keeps what is written to the wire, and flips the bits of the
+// byte at offset flip if it is not negative.
+type recordConn struct {
+	net.Conn
+	wire bytes.Buffer
+	flip int
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	if off := c.flip - c.wire.Len(); c.flip >= 0 && off >= 0 && off < len(b) {
+		b = append([]byte{}, b...)
+		b[off] ^= 0xff
+	}
+	c.wire.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestCipherConn(t *testing.T) {
+	for name, newAEAD := range map[string]func([]byte) (cipher.AEAD, error){
+		"chacha20-poly1305": nil,
+		"aes-256-gcm":       NewAESGCM,
+	} {
+		config := &CipherConfig{Key: []byte("secret"), NewAEAD: newAEAD}
+		c1, c2 := net.Pipe()
+		wire := &recordConn{Conn: c1, flip: -1}
+		client := CipherClient(wire, config)
+		server := CipherServer(c2, config)
+
+		// larger than a record, both ways at the same time
+		data := bytes.Repeat([]byte("0123456789abcdef"), 5000)
+		go func() {
+			client.Write(data)
+		}()
+		go func() {
+			io.Copy(server, io.LimitReader(server, int64(len(data))))
+		}()
+		b := make([]byte, len(data))
+		if _, err := io.ReadFull(client, b); err != nil {
+			t.Fatalf("%s: ReadFull error: %s", name, err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("%s: echo differs", name)
+		}
+		if bytes.Contains(wire.wire.Bytes(), []byte("0123456789abcdef")) {
+			t.Errorf("%s: plain text on the wire", name)
+		}
+		if n := wire.wire.Len(); n <= cipherSaltSize+len(data) {
+			t.Errorf("%s: %d bytes on the wire, want records", name, n)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestCipherConnReject(t *testing.T) {
+	for name, test := range map[string]struct {
+		serverKey string
+		flip      int
+	}{
+		"wrong key": {"wrong", -1},
+		"tampered":  {"secret", cipherSaltSize + 20},
+	} {
+		c1, c2 := net.Pipe()
+		wire := &recordConn{Conn: c1, flip: test.flip}
+		client := CipherClient(wire, &CipherConfig{Key: []byte("secret")})
+		server := CipherServer(c2, &CipherConfig{Key: []byte(test.serverKey)})
+
+		go func() {
+			client.Write([]byte("hello"))
+			client.Close()
+		}()
+		if b, err := ioutil.ReadAll(server); err == nil {
+			t.Errorf("%s: ReadAll = %q, want an error", name, b)
+		}
+		server.Close()
+	}
+}
@@ -2,7 +2,9 @@ package netutil
 
 import (
 	"crypto/tls"
+	"fmt"
 	"net"
+	"net/url"
 	"time"
 )
 
@@ -25,6 +27,13 @@ type Dialer struct {
 	KeepAlive   time.Duration
 	TLSConfig   *tls.Config
 	DNSResolver Resolver
+	ParentProxy *url.URL
+	// ParentProxyFor, if not nil, returns the parent proxy for addr instead
+	// of ParentProxy. A nil url means connecting directly.
+	ParentProxyFor func(addr string) *url.URL
+	// IPTable, if not nil, records the quality of the resolved addresses,
+	// and a dial races the best of them first.
+	IPTable *IPTable
 }
 
 func (d *Dialer) deadline() time.Time {
@@ -39,6 +48,13 @@ func (d *Dialer) deadline() time.Time {
 	}
 }
 
+func (d *Dialer) parentProxy(addr string) *url.URL {
+	if d.ParentProxyFor != nil {
+		return d.ParentProxyFor(addr)
+	}
+	return d.ParentProxy
+}
+
 func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
 	d1 := &net.Dialer{
 		Timeout:   d.Timeout,
@@ -52,29 +68,85 @@ func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
 		resolver = defaultResolver
 	}
 	if network == "tcp" || network == "tcp4" {
+		proxy := d.parentProxy(addr)
 		host, port, err := net.SplitHostPort(addr)
 		if err == nil {
-			addrs, err := resolver.LookupHost(host)
+			addrs, err := lookupHost(resolver, host, proxy != nil)
 			if err == nil {
 				ipaddrs := make([]string, 0)
 				for _, addr := range addrs {
 					ipaddrs = append(ipaddrs, net.JoinHostPort(addr, port))
 				}
-				return d.dialMultiTLS(network, ipaddrs)
+				return d.dialMulti(network, ipaddrs, proxy)
+			}
+		}
+		return d.dialTCP(network, addr, proxy)
+	}
+	if network == "udp" || network == "udp4" {
+		// the parent proxies only carry tcp, and udp must not bypass them
+		if proxy := d.parentProxy(addr); proxy != nil {
+			return nil, fmt.Errorf("netutil: cannot dial %s %s through parent proxy %s", network, addr, proxy.Host)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil && net.ParseIP(host) == nil {
+			addrs, err := resolver.LookupHost(host)
+			if err == nil && len(addrs) > 0 {
+				return d1.Dial(network, net.JoinHostPort(addrs[0], port))
 			}
 		}
 	}
 	return d1.Dial(network, addr)
 }
 
-func (d *Dialer) dialMulti(network string, addrs []string) (net.Conn, error) {
-	d1 := &net.Dialer{
-		Timeout:   d.Timeout,
-		Deadline:  d.Deadline,
-		LocalAddr: d.LocalAddr,
-		DualStack: d.DualStack,
-		KeepAlive: d.KeepAlive,
+func (d *Dialer) dialMulti(network string, addrs []string, proxy *url.URL) (net.Conn, error) {
+	table := d.ipTable(proxy)
+	return dialAddrs(table, addrs, func(raddr string) (net.Conn, error) {
+		start := time.Now()
+		c, err := d.dialTCP(network, raddr, proxy)
+		if table != nil {
+			table.record(raddr, time.Since(start), err)
+			if err == nil {
+				c = &ipConn{Conn: c, table: table, addr: raddr}
+			}
+		}
+		return c, err
+	})
+}
+
+// ipTable returns the IPTable recording the dials through proxy, none for a
+// parent proxy, whose failures and handshakes are not the addresses'.
+func (d *Dialer) ipTable(proxy *url.URL) *IPTable {
+	if proxy != nil {
+		return nil
+	}
+	return d.IPTable
+}
+
+// dialAddrs races the dials of addrs with dial. With table only the
+// selected addresses are raced, and the others if all of them fail.
+func dialAddrs(table *IPTable, addrs []string, dial func(raddr string) (net.Conn, error)) (net.Conn, error) {
+	selected := addrs
+	if table != nil {
+		selected = table.Select(addrs)
+	}
+	conn, err := race(selected, dial)
+	if err != nil && len(selected) < len(addrs) {
+		rest := make([]string, 0, len(addrs)-len(selected))
+		for _, addr := range addrs {
+			if !containsString(selected, addr) {
+				rest = append(rest, addr)
+			}
+		}
+		if len(rest) > 0 {
+			conn, err = race(rest, dial)
+		}
 	}
+	return conn, err
+}
+
+// race dials addrs at once with dial and returns the first connection, the
+// others are closed.
+func race(addrs []string, dial func(raddr string) (net.Conn, error)) (net.Conn, error) {
 	type racer struct {
 		net.Conn
 		error
@@ -82,8 +154,8 @@ func (d *Dialer) dialMulti(network string, addrs []string) (net.Conn, error) {
 	lane := make(chan racer, len(addrs))
 	for _, raddr := range addrs {
 		go func(raddr string) {
-			c, err := d1.Dial(network, raddr)
-			lane <- racer{c, err}
+			conn, err := dial(raddr)
+			lane <- racer{conn, err}
 		}(raddr)
 	}
 	lastErr := errTimeout
@@ -107,6 +179,15 @@ func (d *Dialer) dialMulti(network string, addrs []string) (net.Conn, error) {
 	return nil, lastErr
 }
 
+func containsString(ss []string, s string) bool {
+	for _, s1 := range ss {
+		if s1 == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Dialer) DialTLS(network, addr string) (net.Conn, error) {
 	d1 := &net.Dialer{
 		Timeout:   d.Timeout,
@@ -119,23 +200,24 @@ func (d *Dialer) DialTLS(network, addr string) (net.Conn, error) {
 	if resolver == nil {
 		resolver = defaultResolver
 	}
+	proxy := d.parentProxy(addr)
 	if network == "tcp" || network == "tcp4" {
 		host, port, err := net.SplitHostPort(addr)
 		if err == nil {
-			addrs, err := resolver.LookupHost(host)
+			addrs, err := lookupHost(resolver, host, proxy != nil)
 			if err == nil {
 				ipaddrs := make([]string, 0)
 				for _, addr := range addrs {
 					ipaddrs = append(ipaddrs, net.JoinHostPort(addr, port))
 				}
-				return d.dialMultiTLS(network, ipaddrs)
+				return d.dialMultiTLS(network, ipaddrs, proxy)
 			}
 		}
 	}
-	return tls.DialWithDialer(d1, network, addr, d.TLSConfig)
+	return d.dialTLS(d1, network, addr, d.TLSConfig, proxy)
 }
 
-func (d *Dialer) dialMultiTLS(network string, addrs []string) (net.Conn, error) {
+func (d *Dialer) dialMultiTLS(network string, addrs []string, proxy *url.URL) (net.Conn, error) {
 	d1 := &net.Dialer{
 		Timeout:   d.Timeout,
 		Deadline:  d.Deadline,
@@ -143,45 +225,30 @@ func (d *Dialer) dialMultiTLS(network string, addrs []string) (net.Conn, error)
 		DualStack: d.DualStack,
 		KeepAlive: d.KeepAlive,
 	}
-	type racer struct {
-		net.Conn
-		error
-	}
-	lane := make(chan racer, len(addrs))
-	for _, raddr := range addrs {
-		go func(raddr string) {
-			config := d.TLSConfig
-			if config == nil {
-				config = &tls.Config{
-					InsecureSkipVerify: true,
-				}
-			}
-			if config.ServerName == "" {
-				c := *config
-				c.ServerName = "www.gov.cn"
-				config = &c
+	table := d.ipTable(proxy)
+	return dialAddrs(table, addrs, func(raddr string) (net.Conn, error) {
+		config := d.TLSConfig
+		if config == nil {
+			config = &tls.Config{
+				InsecureSkipVerify: true,
 			}
-			conn, err := tls.DialWithDialer(d1, network, raddr, config)
-			lane <- racer{conn, err}
-		}(raddr)
-	}
-	lastErr := errTimeout
-	nracers := len(addrs)
-	for nracers > 0 {
-		racer := <-lane
-		if racer.error == nil {
-			go func(n int) {
-				for i := 0; i < n; i++ {
-					racer := <-lane
-					if racer.error == nil {
-						racer.Close()
-					}
-				}
-			}(nracers - 1)
-			return racer.Conn, nil
 		}
-		lastErr = racer.error
-		nracers--
-	}
-	return nil, lastErr
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = "www.gov.cn"
+		}
+		if table == nil {
+			return d.dialTLS(d1, network, raddr, config, proxy)
+		}
+		// the rtt is of the tcp handshake as in dialMulti, the resets are
+		// watched under tls
+		start := time.Now()
+		conn, err := d.dialTCP(network, raddr, proxy)
+		rtt := time.Since(start)
+		if err == nil {
+			conn, err = d.handshakeTLS(&ipConn{Conn: conn, table: table, addr: raddr}, raddr, config)
+		}
+		table.record(raddr, rtt, err)
+		return conn, err
+	})
 }
@@ -0,0 +1,277 @@
+package netutil
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// An IPTable keeps the quality of the addresses connected by a Dialer, the
+// handshake times, the failures and the connections reset, the counts decay
+// with HalfLife. A dial to several addresses races the best Candidates of
+// them first, the others only if they all fail, and the addresses failing
+// persistently are quarantined.
+type IPTable struct {
+	// Candidates is the count of addresses raced by a dial, 3 if 0.
+	Candidates int
+	// HalfLife is the time after which the counts weigh half, 10 minutes if
+	// 0.
+	HalfLife time.Duration
+	// An address is quarantined for Quarantine, 5 minutes if 0, after
+	// MaxFailures failures in a row, 3 if 0, or as many more failures and
+	// resets than successes.
+	MaxFailures int
+	Quarantine  time.Duration
+
+	mu    sync.Mutex
+	stats map[string]*IPStat
+}
+
+// IPStat is the quality of an address of an IPTable.
+type IPStat struct {
+	Addr string
+	// RTT is the moving average of the tcp handshake times.
+	RTT       time.Duration
+	Successes float64
+	Failures  float64
+	Resets    float64
+	// Fails is the count of the last failures in a row.
+	Fails            int
+	QuarantinedUntil time.Time
+	Updated          time.Time
+}
+
+func (t *IPTable) candidates() int {
+	if t.Candidates > 0 {
+		return t.Candidates
+	}
+	return 3
+}
+
+func (t *IPTable) halfLife() time.Duration {
+	if t.HalfLife > 0 {
+		return t.HalfLife
+	}
+	return 10 * time.Minute
+}
+
+func (t *IPTable) maxFailures() int {
+	if t.MaxFailures > 0 {
+		return t.MaxFailures
+	}
+	return 3
+}
+
+func (t *IPTable) quarantine() time.Duration {
+	if t.Quarantine > 0 {
+		return t.Quarantine
+	}
+	return 5 * time.Minute
+}
+
+// stat returns the stat of addr decayed to now, t.mu is held.
+func (t *IPTable) stat(addr string, now time.Time) *IPStat {
+	if t.stats == nil {
+		t.stats = make(map[string]*IPStat)
+	}
+	s, ok := t.stats[addr]
+	if !ok {
+		s = &IPStat{Addr: addr, Updated: now}
+		t.stats[addr] = s
+		return s
+	}
+	if elapsed := now.Sub(s.Updated); elapsed > 0 {
+		f := math.Exp2(-float64(elapsed) / float64(t.halfLife()))
+		s.Successes *= f
+		s.Failures *= f
+		s.Resets *= f
+		s.Updated = now
+	}
+	return s
+}
+
+// AddSuccess records a handshake to addr which took rtt.
+func (t *IPTable) AddSuccess(addr string, rtt time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.stat(addr, time.Now())
+	if s.RTT == 0 {
+		s.RTT = rtt
+	} else {
+		s.RTT += (rtt - s.RTT) / 4
+	}
+	s.Successes++
+	s.Fails = 0
+	s.QuarantinedUntil = time.Time{}
+}
+
+// AddFailure records a failed dial to addr.
+func (t *IPTable) AddFailure(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	s := t.stat(addr, now)
+	s.Failures++
+	s.Fails++
+	t.check(s, now)
+}
+
+// AddReset records a connection to addr reset by the peer.
+func (t *IPTable) AddReset(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	s := t.stat(addr, now)
+	s.Resets++
+	t.check(s, now)
+}
+
+func (t *IPTable) check(s *IPStat, now time.Time) {
+	bad := s.Failures + s.Resets
+	if s.Fails >= t.maxFailures() || bad-s.Successes >= float64(t.maxFailures()) {
+		s.QuarantinedUntil = now.Add(t.quarantine())
+	}
+}
+
+// score is the expected time of a handshake, the lower the better. An
+// address which never succeeded is taken for a slow one.
+func (s *IPStat) score() float64 {
+	rtt := s.RTT
+	if rtt == 0 {
+		rtt = time.Second
+	}
+	bad := s.Failures + s.Resets
+	return float64(rtt) / (1 - bad/(s.Successes+bad+1))
+}
+
+// Select returns the addresses to race among addrs, the best Candidates of
+// them. If more than one are raced, one of them is an address never dialed,
+// if any, so that all are tried in time. The quarantined addresses come
+// last.
+func (t *IPTable) Select(addrs []string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+
+	type candidate struct {
+		addr  string
+		score float64
+	}
+	var known, unknown, quarantined []candidate
+	for _, addr := range addrs {
+		s, ok := t.stats[addr]
+		switch {
+		case !ok || s.RTT == 0 && s.Fails == 0:
+			unknown = append(unknown, candidate{addr, 0})
+		case now.Before(s.QuarantinedUntil):
+			quarantined = append(quarantined, candidate{addr, float64(s.QuarantinedUntil.UnixNano())})
+		default:
+			known = append(known, candidate{addr, t.stat(addr, now).score()})
+		}
+	}
+	n := t.candidates()
+	if n > len(addrs) {
+		n = len(addrs)
+	}
+	byScore := func(cs []candidate) {
+		sort.SliceStable(cs, func(i, j int) bool { return cs[i].score < cs[j].score })
+	}
+	byScore(known)
+	rand.Shuffle(len(unknown), func(i, j int) { unknown[i], unknown[j] = unknown[j], unknown[i] })
+	byScore(quarantined)
+
+	selected := make([]string, 0, n)
+	if n > 1 && len(unknown) > 0 {
+		selected = append(selected, unknown[0].addr)
+		unknown = unknown[1:]
+	}
+	for _, cs := range [][]candidate{known, unknown, quarantined} {
+		for _, c := range cs {
+			if len(selected) == n {
+				return selected
+			}
+			selected = append(selected, c.addr)
+		}
+	}
+	return selected
+}
+
+// record records the dial to addr whose tcp handshake took rtt.
+func (t *IPTable) record(addr string, rtt time.Duration, err error) {
+	if err != nil {
+		t.AddFailure(addr)
+	} else {
+		t.AddSuccess(addr, rtt)
+	}
+}
+
+// Stats returns the stats of the addresses, the best first.
+func (t *IPTable) Stats() []IPStat {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	stats := make([]IPStat, 0, len(t.stats))
+	for addr := range t.stats {
+		stats = append(stats, *t.stat(addr, now))
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		qi, qj := now.Before(stats[i].QuarantinedUntil), now.Before(stats[j].QuarantinedUntil)
+		if qi != qj {
+			return qj
+		}
+		return stats[i].score() < stats[j].score()
+	})
+	return stats
+}
+
+// ServeHTTP writes the stats as a text table.
+func (t *IPTable) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w := tabwriter.NewWriter(rw, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ADDR\tRTT\tSUCCESSES\tFAILURES\tRESETS\tQUARANTINED\n")
+	now := time.Now()
+	for _, s := range t.Stats() {
+		quarantined := "-"
+		if now.Before(s.QuarantinedUntil) {
+			quarantined = s.QuarantinedUntil.Sub(now).Truncate(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%.1f\t%.1f\t%s\n", s.Addr, s.RTT.Truncate(time.Millisecond), s.Successes, s.Failures, s.Resets, quarantined)
+	}
+	w.Flush()
+}
+
+// ipConn records the resets of a connection to addr in table.
+type ipConn struct {
+	net.Conn
+	table *IPTable
+	addr  string
+	once  sync.Once
+}
+
+func (c *ipConn) check(err error) {
+	if err != nil && errors.Is(err, syscall.ECONNRESET) {
+		c.once.Do(func() {
+			c.table.AddReset(c.addr)
+		})
+	}
+}
+
+func (c *ipConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.check(err)
+	return n, err
+}
+
+func (c *ipConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.check(err)
+	return n, err
+}
@@ -0,0 +1,235 @@
+package netutil
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIPTableSelect(t *testing.T) {
+	table := &IPTable{Candidates: 2}
+	table.AddSuccess("fast:443", 10*time.Millisecond)
+	table.AddSuccess("slow:443", 15*time.Millisecond)
+	// a fast address which fails half of the time loses to a slow one
+	table.AddSuccess("flaky:443", 10*time.Millisecond)
+	for i := 0; i < 8; i++ {
+		table.AddSuccess("flaky:443", 10*time.Millisecond)
+		table.AddFailure("flaky:443")
+	}
+	for i := 0; i < 3; i++ {
+		table.AddFailure("bad:443")
+	}
+
+	addrs := []string{"bad:443", "flaky:443", "slow:443", "fast:443", "new:443"}
+	if got, want := table.Select(addrs), []string{"new:443", "fast:443"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Select = %v, want %v", got, want)
+	}
+	table.Candidates = 4
+	if got, want := table.Select(addrs), []string{"new:443", "fast:443", "slow:443", "flaky:443"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Select = %v, want %v", got, want)
+	}
+	table.Candidates = 1
+	if got, want := table.Select(addrs), []string{"fast:443"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Select = %v, want %v", got, want)
+	}
+	// all quarantined
+	if got, want := table.Select([]string{"bad:443"}), []string{"bad:443"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Select = %v, want %v", got, want)
+	}
+
+	stats := table.Stats()
+	if len(stats) != 4 || stats[0].Addr != "fast:443" || stats[3].Addr != "bad:443" {
+		t.Errorf("Stats = %+v, want fast:443 first and bad:443 last", stats)
+	}
+}
+
+func TestIPTableQuarantine(t *testing.T) {
+	table := &IPTable{MaxFailures: 2, HalfLife: time.Minute}
+	table.AddSuccess("a:443", 10*time.Millisecond)
+	table.AddFailure("a:443")
+	if s := table.Stats()[0]; !s.QuarantinedUntil.IsZero() {
+		t.Errorf("quarantined after 1 failure")
+	}
+	table.AddFailure("a:443")
+	if s := table.Stats()[0]; s.QuarantinedUntil.IsZero() {
+		t.Errorf("not quarantined after 2 failures")
+	}
+
+	// the counts decay
+	table.mu.Lock()
+	table.stats["a:443"].Updated = time.Now().Add(-time.Minute)
+	table.mu.Unlock()
+	if s := table.Stats()[0]; s.Failures < 0.9 || s.Failures > 1.1 {
+		t.Errorf("Failures = %v a half life later, want 1", s.Failures)
+	}
+
+	// a success lifts the quarantine
+	table.AddSuccess("a:443", 10*time.Millisecond)
+	if s := table.Stats()[0]; !s.QuarantinedUntil.IsZero() || s.Fails != 0 {
+		t.Errorf("quarantined after a success: %+v", s)
+	}
+
+	// resets quarantine addresses whose handshakes succeed
+	for i := 0; i < 4; i++ {
+		table.AddSuccess("b:443", 10*time.Millisecond)
+		table.AddReset("b:443")
+		table.AddReset("b:443")
+	}
+	for _, s := range table.Stats() {
+		if s.Addr == "b:443" && s.QuarantinedUntil.IsZero() {
+			t.Errorf("not quarantined after resets: %+v", s)
+		}
+	}
+}
+
+type resetConn struct {
+	net.Conn
+}
+
+func (c resetConn) Read(b []byte) (int, error) {
+	return 0, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+}
+
+func TestIPTableReset(t *testing.T) {
+	table := &IPTable{}
+	c := &ipConn{Conn: resetConn{}, table: table, addr: "a:443"}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("Read error = %v, want ECONNRESET", err)
+		}
+	}
+	if stats := table.Stats(); len(stats) != 1 || stats[0].Resets < 0.9 || stats[0].Resets > 1.1 {
+		t.Errorf("Stats = %+v, want 1 reset", stats)
+	}
+}
+
+func TestDialerIPTable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	closed.Close()
+
+	table := &IPTable{Candidates: 2}
+	d := &Dialer{Timeout: time.Second, IPTable: table}
+	addrs := []string{closed.Addr().String(), ln.Addr().String()}
+	for i := 0; i < 3; i++ {
+		conn, err := d.dialMulti("tcp", addrs, nil)
+		if err != nil {
+			t.Fatalf("dialMulti error: %s", err)
+		}
+		conn.Close()
+	}
+	// the failures are recorded by the losers
+	time.Sleep(100 * time.Millisecond)
+
+	stats := table.Stats()
+	if len(stats) != 2 || stats[0].Addr != ln.Addr().String() || stats[0].Successes < 2.9 {
+		t.Fatalf("Stats = %+v, want 3 successes to %s first", stats, ln.Addr())
+	}
+	if stats[1].QuarantinedUntil.IsZero() {
+		t.Errorf("%s is not quarantined: %+v", closed.Addr(), stats[1])
+	}
+	table.Candidates = 1
+	if got := table.Select(addrs); len(got) != 1 || got[0] != ln.Addr().String() {
+		t.Errorf("Select = %v, want %s", got, ln.Addr())
+	}
+}
+
+func TestDialerIPTableFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	closed.Close()
+
+	// only the closed address is selected
+	table := &IPTable{Candidates: 1}
+	table.AddSuccess(closed.Addr().String(), time.Millisecond)
+	d := &Dialer{Timeout: time.Second, IPTable: table}
+	conn, err := d.dialMulti("tcp", []string{closed.Addr().String(), ln.Addr().String()}, nil)
+	if err != nil {
+		t.Fatalf("dialMulti error: %s", err)
+	}
+	conn.Close()
+}
+
+func TestDialerIPTableProxy(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	closed.Close()
+
+	// the failures of the parent proxy are not the address'
+	table := &IPTable{}
+	d := &Dialer{Timeout: time.Second, IPTable: table}
+	proxy := &url.URL{Scheme: "http", Host: closed.Addr().String()}
+	if _, err := d.dialMulti("tcp", []string{"1.2.3.4:80"}, proxy); err == nil {
+		t.Fatalf("dialMulti through a closed proxy succeeded")
+	}
+	if _, err := d.dialMultiTLS("tcp", []string{"1.2.3.4:443"}, proxy); err == nil {
+		t.Fatalf("dialMultiTLS through a closed proxy succeeded")
+	}
+	if stats := table.Stats(); len(stats) != 0 {
+		t.Errorf("Stats = %+v, want none", stats)
+	}
+}
+
+func TestDialerIPTableTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+
+	table := &IPTable{}
+	d := &Dialer{Timeout: time.Second, IPTable: table}
+	conn, err := d.dialMultiTLS("tcp", []string{addr}, nil)
+	if err != nil {
+		t.Fatalf("dialMultiTLS error: %s", err)
+	}
+	defer conn.Close()
+	// http.Transport looks for the negotiated protocol
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Errorf("dialMultiTLS returns %T, want *tls.Conn", conn)
+	}
+	if stats := table.Stats(); len(stats) != 1 || stats[0].RTT == 0 {
+		t.Errorf("Stats = %+v, want the handshake to %s", stats, addr)
+	}
+}
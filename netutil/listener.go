@@ -1,7 +1,6 @@
 package netutil
 
 import (
-	"github.com/codahale/chacha20"
 	"github.com/golang/glog"
 	"net"
 	"time"
@@ -24,6 +23,16 @@ type listener struct {
 }
 
 func Listen(network string, addr string) (net.Listener, error) {
+	return listen(network, addr, nil)
+}
+
+// ListenSocks is like Listen, but also serves SOCKS5 clients on the same
+// address. SOCKS5 CONNECT commands are accepted as HTTP CONNECT requests.
+func ListenSocks(network string, addr string, socks *SocksServer) (net.Listener, error) {
+	return listen(network, addr, socks)
+}
+
+func listen(network string, addr string, socks *SocksServer) (net.Listener, error) {
 	ln, err := net.Listen(network, addr)
 	if err != nil {
 		return nil, err
@@ -37,6 +46,20 @@ func Listen(network string, addr string) (net.Listener, error) {
 		var tempDelay time.Duration
 		for {
 			c, e := ln.Accept()
+			if e == nil && socks != nil {
+				go func(c net.Conn) {
+					c1, err := socks.Sniff(c)
+					if err != nil {
+						glog.V(2).Infof("socks: Sniff(%s) error: %v", c.RemoteAddr(), err)
+						c.Close()
+						return
+					}
+					if c1 != nil {
+						ch <- listenerAcceptTuple{c1, nil}
+					}
+				}(c)
+				continue
+			}
 			ch <- listenerAcceptTuple{c, e}
 			if e != nil {
 				if ne, ok := e.(net.Error); ok && ne.Temporary() {
@@ -64,7 +87,7 @@ func (l listener) Accept() (net.Conn, error) {
 	return t.c, t.e
 }
 
-func (l listener) CLose() error {
+func (l listener) Close() error {
 	return l.ln.Close()
 }
 
@@ -81,24 +104,22 @@ type cipherListener struct {
 	key []byte
 }
 
+// ListenCipher is like Listen, but the accepted connections are CipherConns
+// keyed with key, see DialCipher.
+func ListenCipher(network string, addr string, key []byte) (net.Listener, error) {
+	ln, err := listen(network, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return cipherListener{*ln.(*listener), key}, nil
+}
+
 func (l cipherListener) Accept() (net.Conn, error) {
 	t := <-l.ch
 	if t.e != nil {
 		return nil, t.e
 	}
 
-	config := &CipherConfig{
-		Key:             l.key,
-		NonceSize:       chacha20.NonceSize,
-		NewCipherStream: chacha20.New,
-	}
-
-	conn := CipherServer(t.c, config)
-
-	err := conn.Handshake()
-	if err != nil {
-		return nil, err
-	}
-
-	return conn, nil
+	// the handshake runs on the first Read or Write, not to block Accept
+	return CipherServer(t.c, &CipherConfig{Key: l.key}), nil
 }
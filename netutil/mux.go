@@ -0,0 +1,559 @@
+package netutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A MuxSession carries streams over one connection in frames of an 8 bytes
+// header, a version, a command, a 2 bytes length and a 4 bytes stream id,
+// followed by the payload. Clients open odd stream ids, servers even ones.
+// A stream may have StreamWindow unread bytes in flight, the reader credits
+// the writer back with muxUPD frames.
+
+const (
+	muxVersion    = 1
+	muxHeaderSize = 8
+)
+
+const (
+	muxSYN byte = iota // open a stream
+	muxFIN             // close a stream
+	muxPSH             // data
+	muxUPD             // credit the window with the 4 bytes payload
+	muxNOP             // keepalive
+)
+
+var errMuxClosed = errors.New("mux: session closed")
+
+type MuxConfig struct {
+	// KeepAliveInterval is the interval of the keepalives sent, the session
+	// is closed if nothing is received for KeepAliveTimeout.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+	// MaxFrameSize limits the payload of the frames, up to 65535.
+	MaxFrameSize int
+	// StreamWindow is the count of bytes a stream may have in flight.
+	StreamWindow int
+	// AcceptBacklog is the count of opened streams waiting for AcceptStream.
+	AcceptBacklog int
+}
+
+var defaultMuxConfig = MuxConfig{
+	KeepAliveInterval: 10 * time.Second,
+	KeepAliveTimeout:  30 * time.Second,
+	MaxFrameSize:      32 * 1024,
+	StreamWindow:      256 * 1024,
+	AcceptBacklog:     256,
+}
+
+type MuxSession struct {
+	conn   net.Conn
+	config MuxConfig
+
+	writeMu sync.Mutex
+	header  [muxHeaderSize]byte
+
+	mu       sync.Mutex
+	streams  map[uint32]*MuxStream
+	nextID   uint32
+	parity   uint32
+	accepts  chan *MuxStream
+	lastRecv int64
+	pinging  int32
+
+	die       chan struct{}
+	closeOnce sync.Once
+}
+
+// MuxClient returns the client session over conn, config may be nil.
+func MuxClient(conn net.Conn, config *MuxConfig) *MuxSession {
+	return newMuxSession(conn, config, 1)
+}
+
+// MuxServer returns the server session over conn, config may be nil.
+func MuxServer(conn net.Conn, config *MuxConfig) *MuxSession {
+	return newMuxSession(conn, config, 2)
+}
+
+func newMuxSession(conn net.Conn, config *MuxConfig, nextID uint32) *MuxSession {
+	c := defaultMuxConfig
+	if config != nil {
+		if config.KeepAliveInterval > 0 {
+			c.KeepAliveInterval = config.KeepAliveInterval
+		}
+		if config.KeepAliveTimeout > 0 {
+			c.KeepAliveTimeout = config.KeepAliveTimeout
+		}
+		if config.MaxFrameSize > 0 && config.MaxFrameSize <= 0xffff {
+			c.MaxFrameSize = config.MaxFrameSize
+		}
+		if config.StreamWindow > 0 {
+			c.StreamWindow = config.StreamWindow
+		}
+		if config.AcceptBacklog > 0 {
+			c.AcceptBacklog = config.AcceptBacklog
+		}
+	}
+	s := &MuxSession{
+		conn:     conn,
+		config:   c,
+		streams:  make(map[uint32]*MuxStream),
+		nextID:   nextID,
+		parity:   nextID % 2,
+		accepts:  make(chan *MuxStream, c.AcceptBacklog),
+		lastRecv: time.Now().UnixNano(),
+		die:      make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.keepalive()
+	return s
+}
+
+// OpenStream opens a stream to the other end.
+func (s *MuxSession) OpenStream() (*MuxStream, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, errMuxClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newMuxStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxSYN, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for a stream opened by the other end.
+func (s *MuxSession) AcceptStream() (*MuxStream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.die:
+		return nil, errMuxClosed
+	}
+}
+
+// Accept is AcceptStream for the session used as a net.Listener.
+func (s *MuxSession) Accept() (net.Conn, error) {
+	st, err := s.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *MuxSession) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close closes the session and all of its streams.
+func (s *MuxSession) Close() error {
+	err := errMuxClosed
+	s.closeOnce.Do(func() {
+		close(s.die)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+func (s *MuxSession) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// NumStreams returns the count of open streams.
+func (s *MuxSession) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *MuxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *MuxSession) writeFrame(cmd byte, id uint32, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.IsClosed() {
+		return errMuxClosed
+	}
+	s.header[0] = muxVersion
+	s.header[1] = cmd
+	binary.BigEndian.PutUint16(s.header[2:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(s.header[4:], id)
+	if _, err := s.conn.Write(s.header[:]); err != nil {
+		s.Close()
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := s.conn.Write(payload); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MuxSession) recvLoop() {
+	defer s.Close()
+	var header [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+		if header[0] != muxVersion {
+			return
+		}
+		cmd, size, id := header[1], int(binary.BigEndian.Uint16(header[2:])), binary.BigEndian.Uint32(header[4:])
+		var payload []byte
+		if size > 0 {
+			payload = make([]byte, size)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				return
+			}
+		}
+
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+		switch cmd {
+		case muxSYN:
+			if st != nil || id%2 == s.parity {
+				return
+			}
+			st = newMuxStream(s, id)
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+			select {
+			case s.accepts <- st:
+			default:
+				// the backlog is full
+				s.removeStream(id)
+				s.writeFrame(muxFIN, id, nil)
+			}
+		case muxFIN:
+			if st != nil {
+				st.remoteClose()
+			}
+		case muxPSH:
+			if st != nil && !st.push(payload) {
+				// the window is overrun
+				return
+			}
+		case muxUPD:
+			if len(payload) != 4 {
+				return
+			}
+			if st != nil {
+				st.credit(int(binary.BigEndian.Uint32(payload)))
+			}
+		case muxNOP:
+		default:
+			return
+		}
+	}
+}
+
+func (s *MuxSession) keepalive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecv))) > s.config.KeepAliveTimeout {
+				s.Close()
+				return
+			}
+			// a write may block, e.g. in the handshake of a CipherConn with
+			// a silent peer, and must not hold up the timeout
+			if atomic.CompareAndSwapInt32(&s.pinging, 0, 1) {
+				go func() {
+					s.writeFrame(muxNOP, 0, nil)
+					atomic.StoreInt32(&s.pinging, 0)
+				}()
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// MuxStream is a stream of a MuxSession. Close sends a FIN to the other end,
+// which reads the data in flight and then io.EOF.
+type MuxStream struct {
+	sess *MuxSession
+	id   uint32
+
+	mu           sync.Mutex
+	buf          bytes.Buffer
+	consumed     int
+	sendWindow   int
+	localClosed  bool
+	remoteClosed bool
+
+	readEvent     chan struct{}
+	writeEvent    chan struct{}
+	readDeadline  atomic.Value
+	writeDeadline atomic.Value
+}
+
+func newMuxStream(s *MuxSession, id uint32) *MuxStream {
+	st := &MuxStream{
+		sess:       s,
+		id:         id,
+		sendWindow: s.config.StreamWindow,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+	}
+	st.readDeadline.Store(time.Time{})
+	st.writeDeadline.Store(time.Time{})
+	return st
+}
+
+func muxNotify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits for an event on ch until deadline.
+func (st *MuxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := deadline.Sub(time.Now())
+		if d <= 0 {
+			return errTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-st.sess.die:
+		return errMuxClosed
+	case <-timeout:
+		return errTimeout
+	}
+}
+
+func (st *MuxStream) push(b []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.localClosed {
+		return true
+	}
+	if st.buf.Len()+len(b) > st.sess.config.StreamWindow {
+		return false
+	}
+	st.buf.Write(b)
+	muxNotify(st.readEvent)
+	return true
+}
+
+func (st *MuxStream) credit(n int) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	muxNotify(st.writeEvent)
+}
+
+func (st *MuxStream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	st.mu.Unlock()
+	muxNotify(st.readEvent)
+	muxNotify(st.writeEvent)
+}
+
+func (st *MuxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.localClosed {
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.consumed += n
+			var credit int
+			if st.consumed >= st.sess.config.StreamWindow/2 {
+				credit, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+			if credit > 0 {
+				var payload [4]byte
+				binary.BigEndian.PutUint32(payload[:], uint32(credit))
+				st.sess.writeFrame(muxUPD, st.id, payload[:])
+			}
+			return n, nil
+		}
+		if st.remoteClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		st.mu.Unlock()
+
+		if err := st.wait(st.readEvent, st.readDeadline.Load().(time.Time)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *MuxStream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		st.mu.Lock()
+		if st.localClosed || st.remoteClosed {
+			st.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		size := st.sendWindow
+		if size == 0 {
+			st.mu.Unlock()
+			if err := st.wait(st.writeEvent, st.writeDeadline.Load().(time.Time)); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if size > len(b) {
+			size = len(b)
+		}
+		if size > st.sess.config.MaxFrameSize {
+			size = st.sess.config.MaxFrameSize
+		}
+		st.sendWindow -= size
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(muxPSH, st.id, b[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// Close sends a FIN to the other end, the stream can no longer be read or
+// written.
+func (st *MuxStream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+	st.localClosed = true
+	st.buf.Reset()
+	st.mu.Unlock()
+	muxNotify(st.readEvent)
+	muxNotify(st.writeEvent)
+
+	st.sess.removeStream(st.id)
+	return st.sess.writeFrame(muxFIN, st.id, nil)
+}
+
+func (st *MuxStream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+func (st *MuxStream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.Store(t)
+	muxNotify(st.readEvent)
+	return nil
+}
+
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.Store(t)
+	muxNotify(st.writeEvent)
+	return nil
+}
+
+// muxListener accepts the streams of the sessions over the connections of a
+// listener.
+type muxListener struct {
+	net.Listener
+	config  *MuxConfig
+	streams chan net.Conn
+	die     chan struct{}
+	err     error
+}
+
+// MuxListener returns a listener of the streams opened by the MuxClients
+// connecting ln, config may be nil.
+func MuxListener(ln net.Listener, config *MuxConfig) net.Listener {
+	l := &muxListener{
+		Listener: ln,
+		config:   config,
+		streams:  make(chan net.Conn),
+		die:      make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+func (l *muxListener) serve() {
+	defer close(l.die)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			return
+		}
+		go func(s *MuxSession) {
+			for {
+				st, err := s.AcceptStream()
+				if err != nil {
+					return
+				}
+				select {
+				case l.streams <- st:
+				case <-l.die:
+					s.Close()
+					return
+				}
+			}
+		}(MuxServer(conn, l.config))
+	}
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.streams:
+		return conn, nil
+	case <-l.die:
+		return nil, l.err
+	}
+}
@@ -0,0 +1,216 @@
+package netutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoSessions returns a client session over net.Pipe whose server echoes
+// the streams.
+func echoSessions(config *MuxConfig) (*MuxSession, *MuxSession) {
+	c1, c2 := net.Pipe()
+	client := MuxClient(c1, config)
+	server := MuxServer(c2, config)
+	go func() {
+		for {
+			st, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+	return client, server
+}
+
+func TestMuxStreams(t *testing.T) {
+	client, server := echoSessions(&MuxConfig{StreamWindow: 4096, MaxFrameSize: 1024})
+	defer server.Close()
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := client.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer st.Close()
+			// larger than the window, so the writes wait for the credits
+			data := bytes.Repeat([]byte(fmt.Sprintf("stream %03d ", i)), 2000)
+			go st.Write(data)
+			b := make([]byte, len(data))
+			if _, err := io.ReadFull(st, b); err != nil {
+				errs <- fmt.Errorf("stream %d: ReadFull error: %s", i, err)
+				return
+			}
+			if !bytes.Equal(b, data) {
+				errs <- fmt.Errorf("stream %d: echo differs", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := client.NumStreams(); n != 0 {
+		t.Errorf("client.NumStreams() = %d, want 0", n)
+	}
+	if n := server.NumStreams(); n != 0 {
+		t.Errorf("server.NumStreams() = %d, want 0", n)
+	}
+}
+
+func TestMuxStreamClose(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := MuxClient(c1, nil)
+	server := MuxServer(c2, nil)
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream error: %s", err)
+	}
+	st.Write([]byte("hello"))
+	st.Close()
+	if _, err := st.Write([]byte("again")); err == nil {
+		t.Errorf("Write after Close succeeded")
+	}
+
+	// the data in flight is read before io.EOF
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream error: %s", err)
+	}
+	b, err := ioutil.ReadAll(peer)
+	if err != nil || string(b) != "hello" {
+		t.Errorf("ReadAll = %q, %v, want %q", b, err, "hello")
+	}
+	if _, err := peer.Write([]byte("late")); err == nil {
+		t.Errorf("Write to a closed stream succeeded")
+	}
+	peer.Close()
+}
+
+func TestMuxDeadline(t *testing.T) {
+	client, server := echoSessions(nil)
+	defer server.Close()
+	defer client.Close()
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream error: %s", err)
+	}
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = st.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Read error = %v, want a timeout", err)
+	}
+
+	// the stream is usable once the deadline is cleared
+	st.SetReadDeadline(time.Time{})
+	st.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(st, b); err != nil || string(b) != "ping" {
+		t.Errorf("ReadFull = %q, %v, want %q", b, err, "ping")
+	}
+}
+
+func TestMuxKeepAlive(t *testing.T) {
+	config := &MuxConfig{KeepAliveInterval: 20 * time.Millisecond, KeepAliveTimeout: 100 * time.Millisecond}
+
+	// both ends alive, the keepalives hold the idle session open
+	client, server := echoSessions(config)
+	time.Sleep(300 * time.Millisecond)
+	if client.IsClosed() || server.IsClosed() {
+		t.Errorf("idle session closed")
+	}
+	client.Close()
+	server.Close()
+
+	// a silent peer is dropped
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c2)
+	client = MuxClient(c1, config)
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream error: %s", err)
+	}
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Read succeeded over a silent peer")
+	}
+	if !client.IsClosed() {
+		t.Errorf("session over a silent peer is not closed")
+	}
+
+	// a client which never handshakes is dropped too
+	c1, c2 = net.Pipe()
+	defer c1.Close()
+	server = MuxServer(CipherServer(c2, &CipherConfig{Key: []byte("secret")}), config)
+	select {
+	case <-server.die:
+	case <-time.After(time.Second):
+		t.Errorf("session of a client which never handshakes is not closed")
+	}
+}
+
+func TestMuxListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	mln := MuxListener(ln, nil)
+	defer mln.Close()
+	go func() {
+		for {
+			conn, err := mln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial error: %s", err)
+		}
+		client := MuxClient(conn, nil)
+		for j := 0; j < 3; j++ {
+			st, err := client.OpenStream()
+			if err != nil {
+				t.Fatalf("OpenStream error: %s", err)
+			}
+			msg := fmt.Sprintf("session %d stream %d", i, j)
+			st.Write([]byte(msg))
+			b := make([]byte, len(msg))
+			if _, err := io.ReadFull(st, b); err != nil || string(b) != msg {
+				t.Errorf("ReadFull = %q, %v, want %q", b, err, msg)
+			}
+			st.Close()
+		}
+		client.Close()
+	}
+}
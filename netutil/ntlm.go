@@ -0,0 +1,146 @@
+package netutil
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/md4"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// NTLM messages as specified in [MS-NLMP], only NTLMv2 responses are sent.
+
+const (
+	ntlmNegotiateUnicode         uint32 = 0x00000001
+	ntlmNegotiateOEM             uint32 = 0x00000002
+	ntlmRequestTarget            uint32 = 0x00000004
+	ntlmNegotiateNTLM            uint32 = 0x00000200
+	ntlmNegotiateAlwaysSign      uint32 = 0x00008000
+	ntlmNegotiateExtendedSession uint32 = 0x00080000
+	ntlmNegotiateTargetInfo      uint32 = 0x00800000
+)
+
+var (
+	ntlmSignature = []byte("NTLMSSP\x00")
+
+	errNTLMChallenge = errors.New("ntlm: malformed challenge message")
+)
+
+// ntlmCredential splits a "DOMAIN\user" username.
+func ntlmCredential(username string) (domain, user string) {
+	if i := strings.IndexByte(username, '\\'); i >= 0 {
+		return username[:i], username[i+1:]
+	}
+	return "", username
+}
+
+func ntlmUTF16(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, r := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
+
+func ntlmNegotiateMessage() []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], ntlmNegotiateUnicode|ntlmNegotiateOEM|ntlmRequestTarget|ntlmNegotiateNTLM|ntlmNegotiateAlwaysSign|ntlmNegotiateExtendedSession)
+	return b
+}
+
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  [8]byte
+	targetInfo []byte
+}
+
+func parseNTLMChallenge(b []byte) (*ntlmChallenge, error) {
+	if len(b) < 32 || !bytes.Equal(b[:8], ntlmSignature) || binary.LittleEndian.Uint32(b[8:]) != 2 {
+		return nil, errNTLMChallenge
+	}
+	c := &ntlmChallenge{
+		flags: binary.LittleEndian.Uint32(b[20:]),
+	}
+	copy(c.challenge[:], b[24:32])
+	if c.flags&ntlmNegotiateTargetInfo != 0 && len(b) >= 48 {
+		n := int(binary.LittleEndian.Uint16(b[40:]))
+		off := int(binary.LittleEndian.Uint32(b[44:]))
+		if off+n > len(b) {
+			return nil, errNTLMChallenge
+		}
+		c.targetInfo = b[off : off+n]
+	}
+	return c, nil
+}
+
+func ntlmHMAC(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, b := range data {
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+func ntlmV2Hash(domain, user, password string) []byte {
+	h := md4.New()
+	h.Write(ntlmUTF16(password))
+	return ntlmHMAC(h.Sum(nil), ntlmUTF16(strings.ToUpper(user)+domain))
+}
+
+// ntlmV2Response returns the LMv2 and NTLMv2 responses to challenge.
+func ntlmV2Response(hash []byte, challenge, clientChallenge []byte, timestamp uint64, targetInfo []byte) ([]byte, []byte) {
+	temp := make([]byte, 28, 28+len(targetInfo)+4)
+	temp[0], temp[1] = 1, 1
+	binary.LittleEndian.PutUint64(temp[8:], timestamp)
+	copy(temp[16:], clientChallenge)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	nt := append(ntlmHMAC(hash, challenge, temp), temp...)
+	lm := append(ntlmHMAC(hash, challenge, clientChallenge), clientChallenge...)
+	return lm, nt
+}
+
+// ntlmTimestamp is the count of 100 nanoseconds since January 1, 1601.
+func ntlmTimestamp(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + 116444736000000000
+}
+
+func ntlmAuthenticateMessage(c *ntlmChallenge, domain, user, password string) ([]byte, error) {
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	lm, nt := ntlmV2Response(ntlmV2Hash(domain, user, password), c.challenge[:], clientChallenge, ntlmTimestamp(time.Now()), c.targetInfo)
+
+	var encode func(string) []byte
+	flags := ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSession | ntlmRequestTarget
+	if c.flags&ntlmNegotiateUnicode != 0 {
+		encode = ntlmUTF16
+		flags |= ntlmNegotiateUnicode
+	} else {
+		encode = func(s string) []byte { return []byte(s) }
+		flags |= ntlmNegotiateOEM
+	}
+
+	b := make([]byte, 64)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	binary.LittleEndian.PutUint32(b[60:], flags)
+	for i, field := range [][]byte{lm, nt, encode(domain), encode(user), encode(""), nil} {
+		off := 12 + 8*i
+		binary.LittleEndian.PutUint16(b[off:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(b[off+2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(b[off+4:], uint32(len(b)))
+		b = append(b, field...)
+	}
+	return b, nil
+}
@@ -0,0 +1,35 @@
+package netutil
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors of [MS-NLMP] 4.2.4.
+func TestNTLMv2Response(t *testing.T) {
+	hash := ntlmV2Hash("Domain", "User", "Password")
+	if got, want := hex.EncodeToString(hash), "0c868a403bfd7a93a3001ef22ef02e3f"; got != want {
+		t.Errorf("ntlmV2Hash = %s, want %s", got, want)
+	}
+
+	challenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge := bytes.Repeat([]byte{0xaa}, 8)
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c00530065007200760065007200" + "00000000")
+	lm, nt := ntlmV2Response(hash, challenge, clientChallenge, 0, targetInfo)
+	if got, want := hex.EncodeToString(lm), "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"; got != want {
+		t.Errorf("LMv2 response = %s, want %s", got, want)
+	}
+	if got, want := hex.EncodeToString(nt[:16]), "68cd0ab851e51c96aabc927bebef6a1c"; got != want {
+		t.Errorf("NTProofStr = %s, want %s", got, want)
+	}
+}
+
+func TestNTLMCredential(t *testing.T) {
+	if domain, user := ntlmCredential(`CORP\alice`); domain != "CORP" || user != "alice" {
+		t.Errorf("ntlmCredential = %#v, %#v", domain, user)
+	}
+	if domain, user := ntlmCredential("alice"); domain != "" || user != "alice" {
+		t.Errorf("ntlmCredential = %#v, %#v", domain, user)
+	}
+}
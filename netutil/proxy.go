@@ -0,0 +1,395 @@
+package netutil
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNoStaticHost = errors.New("netutil: no static host")
+
+// lookupHost resolves host with resolver. Only the static hosts of resolver
+// are used when dialing through a parent proxy, which resolves names itself.
+func lookupHost(resolver Resolver, host string, remote bool) ([]string, error) {
+	if !remote {
+		return resolver.LookupHost(host)
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if r, ok := resolver.(interface {
+		lookupHostInMemory(string) ([]string, error)
+	}); ok {
+		if addrs, err := r.lookupHostInMemory(host); err == nil && len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, errNoStaticHost
+}
+
+// dialTCP connects to addr, through proxy if it is not nil.
+func (d *Dialer) dialTCP(network, addr string, proxy *url.URL) (net.Conn, error) {
+	d1 := &net.Dialer{
+		Timeout:   d.Timeout,
+		Deadline:  d.Deadline,
+		LocalAddr: d.LocalAddr,
+		DualStack: d.DualStack,
+		KeepAlive: d.KeepAlive,
+	}
+	if proxy == nil {
+		return d1.Dial(network, addr)
+	}
+
+	conn, err := d1.Dial(network, proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline := d.deadline(); !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+	}
+
+	var conn1 net.Conn
+	switch proxy.Scheme {
+	case "http", "":
+		conn1, err = d.handshakeHTTPProxy(conn, addr, proxy)
+	case "socks5", "socks5h":
+		err = handshakeSocks5Proxy(conn, addr, proxy)
+	case "socks4", "socks4a":
+		err = d.handshakeSocks4Proxy(conn, addr, proxy)
+	default:
+		err = fmt.Errorf("netutil: unsupported parent proxy scheme %#v", proxy.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	if conn1 != nil {
+		return conn1, nil
+	}
+	return conn, nil
+}
+
+// dialTLS is tls.DialWithDialer through proxy.
+func (d *Dialer) dialTLS(d1 *net.Dialer, network, addr string, config *tls.Config, proxy *url.URL) (net.Conn, error) {
+	if proxy == nil {
+		return tls.DialWithDialer(d1, network, addr, config)
+	}
+
+	conn, err := d.dialTCP(network, addr, proxy)
+	if err != nil {
+		return nil, err
+	}
+	return d.handshakeTLS(conn, addr, config)
+}
+
+// handshakeTLS runs a tls client handshake to addr over conn, which is
+// closed if it fails.
+func (d *Dialer) handshakeTLS(conn net.Conn, addr string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if deadline := d.deadline(); !deadline.IsZero() {
+		tlsConn.SetDeadline(deadline)
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func proxyBasicAuth(u *url.URL) string {
+	if u.User == nil {
+		return ""
+	}
+	password, _ := u.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+}
+
+// handshakeHTTPProxy opens a tunnel to addr with a HTTP CONNECT request. It
+// returns a non-nil net.Conn if the proxy sent data after its response.
+func (d *Dialer) handshakeHTTPProxy(conn net.Conn, addr string, proxy *url.URL) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	br := bufio.NewReader(conn)
+	resp, _, err := roundTripProxy(conn, br, req, proxy, proxyWantsNTLM(proxy))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("netutil: parent proxy %s CONNECT %s return %s", proxy.Host, addr, strings.TrimSpace(resp.Status))
+	}
+
+	if br.Buffered() > 0 {
+		return &sniffConn{conn, br}, nil
+	}
+	return nil, nil
+}
+
+// proxyWantsNTLM reports whether the username of proxy is in the
+// "DOMAIN\user" form, which goes straight to NTLM instead of Basic.
+func proxyWantsNTLM(proxy *url.URL) bool {
+	return proxy.User != nil && strings.Contains(proxy.User.Username(), "\\")
+}
+
+// proxyNTLMChallenge returns the NTLM token of the Proxy-Authenticate headers
+// of resp, ok is false if the proxy does not offer NTLM.
+func proxyNTLMChallenge(resp *http.Response) (token string, ok bool) {
+	for _, v := range resp.Header["Proxy-Authenticate"] {
+		fields := strings.Fields(v)
+		if len(fields) > 0 && strings.EqualFold(fields[0], "NTLM") {
+			if len(fields) > 1 {
+				token = fields[1]
+			}
+			return token, true
+		}
+	}
+	return "", false
+}
+
+func proxyRequestHasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody
+}
+
+func writeProxyRequest(w io.Writer, req *http.Request, auth string) error {
+	req1 := new(http.Request)
+	*req1 = *req
+	req1.Header = make(http.Header, len(req.Header)+1)
+	for key, values := range req.Header {
+		req1.Header[key] = values
+	}
+	if auth != "" {
+		req1.Header.Set("Proxy-Authorization", auth)
+	}
+	if req.Method == "CONNECT" {
+		return req1.Write(w)
+	}
+	return req1.WriteProxy(w)
+}
+
+// roundTripProxy sends req to the parent proxy over conn, with Basic or NTLM
+// authentication. As NTLM authorizes the connection, the negotiate message
+// goes with a copy of req without body and only the authenticate message
+// carries req itself. A 407 response is returned as is if req has a body
+// that would have to be sent twice. authorized reports whether the
+// connection has been authorized with NTLM.
+func roundTripProxy(conn net.Conn, br *bufio.Reader, req *http.Request, proxy *url.URL, ntlm bool) (resp *http.Response, authorized bool, err error) {
+	if proxy.User == nil {
+		if err := writeProxyRequest(conn, req, ""); err != nil {
+			return nil, false, err
+		}
+		resp, err = http.ReadResponse(br, req)
+		return resp, false, err
+	}
+
+	if !ntlm {
+		if err := writeProxyRequest(conn, req, proxyBasicAuth(proxy)); err != nil {
+			return nil, false, err
+		}
+		resp, err = http.ReadResponse(br, req)
+		if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+			return resp, false, err
+		}
+		if _, ok := proxyNTLMChallenge(resp); !ok || resp.Close || proxyRequestHasBody(req) {
+			return resp, false, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	negotiate := new(http.Request)
+	*negotiate = *req
+	negotiate.Body = nil
+	negotiate.ContentLength = 0
+	if err := writeProxyRequest(conn, negotiate, "NTLM "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage())); err != nil {
+		return nil, false, err
+	}
+	resp, err = http.ReadResponse(br, negotiate)
+	if err != nil {
+		return nil, false, err
+	}
+	token, _ := proxyNTLMChallenge(resp)
+	if resp.StatusCode != http.StatusProxyAuthRequired || token == "" {
+		if proxyRequestHasBody(req) {
+			resp.Body.Close()
+			return nil, false, fmt.Errorf("netutil: parent proxy %s answer NTLM negotiate with %s", proxy.Host, strings.TrimSpace(resp.Status))
+		}
+		return resp, false, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	b, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, false, err
+	}
+	challenge, err := parseNTLMChallenge(b)
+	if err != nil {
+		return nil, false, err
+	}
+	domain, user := ntlmCredential(proxy.User.Username())
+	password, _ := proxy.User.Password()
+	b, err = ntlmAuthenticateMessage(challenge, domain, user, password)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := writeProxyRequest(conn, req, "NTLM "+base64.StdEncoding.EncodeToString(b)); err != nil {
+		return nil, false, err
+	}
+	resp, err = http.ReadResponse(br, req)
+	return resp, err == nil && resp.StatusCode != http.StatusProxyAuthRequired, err
+}
+
+// handshakeSocks5Proxy sends a SOCKS5 CONNECT. Host names are passed to the
+// proxy as is, so that they are resolved remotely.
+func handshakeSocks5Proxy(conn net.Conn, addr string, proxy *url.URL) error {
+	var err error
+	if proxy.User != nil {
+		_, err = conn.Write([]byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword})
+	} else {
+		_, err = conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	}
+	if err != nil {
+		return err
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return fmt.Errorf("netutil: parent proxy %s is not a socks5 proxy", proxy.Host)
+	}
+	switch b[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if proxy.User == nil {
+			return fmt.Errorf("netutil: parent proxy %s requires authentication", proxy.Host)
+		}
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		msg := []byte{0x01, byte(len(username))}
+		msg = append(msg, username...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return err
+		}
+		if b[1] != 0x00 {
+			return fmt.Errorf("netutil: parent proxy %s authentication failed", proxy.Host)
+		}
+	default:
+		return fmt.Errorf("netutil: parent proxy %s has no acceptable authentication method", proxy.Host)
+	}
+
+	msg, err := appendSocks5HostPort([]byte{socks5Version, socks5CmdConnect, 0x00}, addr)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != socks5RepSucceeded {
+		return fmt.Errorf("netutil: parent proxy %s CONNECT %s return %#x", proxy.Host, addr, reply[1])
+	}
+	_, err = readSocks5Addr(conn)
+	return err
+}
+
+// handshakeSocks4Proxy sends a SOCKS4 CONNECT, with the SOCKS4a extension for
+// host names.
+func (d *Dialer) handshakeSocks4Proxy(conn net.Conn, addr string, proxy *url.URL) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host).To4()
+	if ip == nil && proxy.Scheme == "socks4" {
+		resolver := d.DNSResolver
+		if resolver == nil {
+			resolver = defaultResolver
+		}
+		addrs, err := resolver.LookupHost(host)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if ip = net.ParseIP(addr).To4(); ip != nil {
+				break
+			}
+		}
+		if ip == nil {
+			return fmt.Errorf("netutil: no ipv4 address for %#v", host)
+		}
+	}
+
+	msg := []byte{0x04, socks5CmdConnect, 0, 0}
+	binary.BigEndian.PutUint16(msg[2:], uint16(port))
+	if ip != nil {
+		msg = append(msg, ip...)
+	} else {
+		msg = append(msg, 0, 0, 0, 1)
+	}
+	if proxy.User != nil {
+		msg = append(msg, proxy.User.Username()...)
+	}
+	msg = append(msg, 0)
+	if ip == nil {
+		msg = append(msg, host...)
+		msg = append(msg, 0)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	var reply [8]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0x5a {
+		return fmt.Errorf("netutil: parent proxy %s CONNECT %s return %#x", proxy.Host, addr, reply[1])
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+package netutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectProxy is a minimal HTTP CONNECT proxy.
+type connectProxy struct {
+	auth string
+}
+
+func (p *connectProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		http.Error(rw, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.auth != "" && req.Header.Get("Proxy-Authorization") != p.auth {
+		rw.Header().Set("Proxy-Authenticate", "Basic realm=\"test\"")
+		rw.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	remote, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	local, _, _ := rw.(http.Hijacker).Hijack()
+	io.WriteString(local, "HTTP/1.1 200 OK\r\n\r\n")
+	go io.Copy(remote, local)
+	io.Copy(local, remote)
+	local.Close()
+	remote.Close()
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %s", err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func startProxyServer(t *testing.T, h http.Handler) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %s", err)
+	}
+	go http.Serve(ln, h)
+	return ln
+}
+
+func TestDialParentProxy(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	proxy := startProxyServer(t, &connectProxy{auth: "Basic dXNlcjpwYXNz"})
+	defer proxy.Close()
+
+	d := &Dialer{
+		Timeout:     5 * time.Second,
+		ParentProxy: &url.URL{Scheme: "http", Host: proxy.Addr().String(), User: url.UserPassword("user", "pass")},
+	}
+	conn, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial through parent proxy error: %s", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "hello")
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Errorf("echo = %q, %v, want %q", b, err, "hello")
+	}
+
+	d.ParentProxy.User = url.UserPassword("user", "wrong")
+	if conn, err := d.Dial("tcp", echo.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("Dial with a wrong password succeeded")
+	}
+}
+
+// startSocksServer serves SOCKS5 with SocksServer, dialing the translated
+// CONNECT requests directly.
+func startSocksServer(t *testing.T, s *SocksServer) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %s", err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c1, err := s.Sniff(c)
+				if err != nil || c1 == nil {
+					return
+				}
+				br := bufio.NewReader(c1)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				remote, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c1, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer remote.Close()
+				io.WriteString(c1, "HTTP/1.1 200 OK\r\n\r\n")
+				go io.Copy(remote, br)
+				io.Copy(c1, remote)
+			}()
+		}
+	}()
+	return ln
+}
+
+// startSocks4Server serves SOCKS4a CONNECT and records the requested hosts.
+func startSocks4Server(t *testing.T, hosts chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %s", err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				var hdr [8]byte
+				if _, err := io.ReadFull(br, hdr[:]); err != nil {
+					return
+				}
+				if _, err := br.ReadString(0); err != nil {
+					return
+				}
+				host := net.IP(hdr[4:8]).String()
+				if hdr[4] == 0 && hdr[5] == 0 && hdr[6] == 0 {
+					if host, err = br.ReadString(0); err != nil {
+						return
+					}
+					host = host[:len(host)-1]
+				}
+				hosts <- host
+				port := int(hdr[2])<<8 | int(hdr[3])
+				remote, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+				if err != nil {
+					c.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer remote.Close()
+				c.Write([]byte{0, 0x5a, 0, 0, 0, 0, 0, 0})
+				go io.Copy(remote, br)
+				io.Copy(c, remote)
+			}()
+		}
+	}()
+	return ln
+}
+
+func testEcho(t *testing.T, d *Dialer, addr string) {
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial(%#v) error: %s", addr, err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "hello")
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Errorf("echo = %q, %v, want %q", b, err, "hello")
+	}
+}
+
+func TestDialSocks5Proxy(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	proxy := startSocksServer(t, &SocksServer{
+		Auth: func(username, password string) bool {
+			return username == "user" && password == "pass"
+		},
+	})
+	defer proxy.Close()
+
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	d := &Dialer{
+		Timeout:     5 * time.Second,
+		ParentProxy: &url.URL{Scheme: "socks5", Host: proxy.Addr().String(), User: url.UserPassword("user", "pass")},
+	}
+	testEcho(t, d, echo.Addr().String())
+	// host names are resolved by the proxy
+	testEcho(t, d, net.JoinHostPort("localhost", port))
+
+	d.ParentProxy.User = url.UserPassword("user", "wrong")
+	if conn, err := d.Dial("tcp", echo.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("Dial with a wrong password succeeded")
+	}
+}
+
+func TestDialSocks4aProxy(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	hosts := make(chan string, 1)
+	proxy := startSocks4Server(t, hosts)
+	defer proxy.Close()
+
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	d := &Dialer{
+		Timeout:     5 * time.Second,
+		ParentProxy: &url.URL{Scheme: "socks4a", Host: proxy.Addr().String()},
+	}
+	testEcho(t, d, net.JoinHostPort("echo.invalid", port))
+	if host := <-hosts; host != "echo.invalid" {
+		t.Errorf("socks4a host = %#v, want %#v", host, "echo.invalid")
+	}
+}
+
+func TestDialParentProxyFor(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	hosts := make(chan string, 1)
+	proxy := startSocks4Server(t, hosts)
+	defer proxy.Close()
+
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	d := &Dialer{
+		Timeout: 5 * time.Second,
+		ParentProxyFor: func(addr string) *url.URL {
+			if host, _, _ := net.SplitHostPort(addr); host == "echo.invalid" {
+				return &url.URL{Scheme: "socks4a", Host: proxy.Addr().String()}
+			}
+			return nil
+		},
+	}
+	testEcho(t, d, net.JoinHostPort("echo.invalid", port))
+	if host := <-hosts; host != "echo.invalid" {
+		t.Errorf("socks4a host = %#v, want %#v", host, "echo.invalid")
+	}
+	testEcho(t, d, echo.Addr().String())
+	select {
+	case host := <-hosts:
+		t.Errorf("%s is dialed through the proxy", host)
+	default:
+	}
+}
+
+// ntlmProxy is a stand-in parent proxy which authorizes connections with
+// NTLMv2 and serves both CONNECT and plain requests.
+type ntlmProxy struct {
+	domain, user, password string
+	challenge              [8]byte
+	handshakes             chan string
+}
+
+func (p *ntlmProxy) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	authorized := false
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body)
+		if !authorized {
+			auth := strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "NTLM ")
+			msg, _ := base64.StdEncoding.DecodeString(auth)
+			switch {
+			case len(msg) > 12 && msg[8] == 1:
+				challenge := make([]byte, 48)
+				copy(challenge, ntlmSignature)
+				challenge[8] = 2
+				binary.LittleEndian.PutUint32(challenge[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM)
+				copy(challenge[24:], p.challenge[:])
+				io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM "+base64.StdEncoding.EncodeToString(challenge)+"\r\nContent-Length: 0\r\n\r\n")
+				continue
+			case len(msg) > 64 && msg[8] == 3 && p.verify(msg):
+				authorized = true
+				p.handshakes <- req.Method
+			default:
+				io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nProxy-Authenticate: Basic realm=\"test\"\r\nContent-Length: 0\r\n\r\n")
+				continue
+			}
+		}
+
+		if req.Method == "CONNECT" {
+			remote, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+				return
+			}
+			defer remote.Close()
+			io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+			go io.Copy(remote, br)
+			io.Copy(c, remote)
+			return
+		}
+		body := req.Method + " " + req.URL.String()
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	}
+}
+
+func (p *ntlmProxy) verify(msg []byte) bool {
+	field := func(i int) []byte {
+		off := 12 + 8*i
+		n := int(binary.LittleEndian.Uint16(msg[off:]))
+		start := int(binary.LittleEndian.Uint32(msg[off+4:]))
+		if start+n > len(msg) {
+			return nil
+		}
+		return msg[start : start+n]
+	}
+	nt := field(1)
+	if len(nt) < 16 || !bytes.Equal(field(2), ntlmUTF16(p.domain)) || !bytes.Equal(field(3), ntlmUTF16(p.user)) {
+		return false
+	}
+	proof := ntlmHMAC(ntlmV2Hash(p.domain, p.user, p.password), p.challenge[:], nt[16:])
+	return bytes.Equal(proof, nt[:16])
+}
+
+func startNTLMProxy(t *testing.T, p *ntlmProxy) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %s", err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(c)
+		}
+	}()
+	return ln
+}
+
+func TestDialNTLMProxy(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	p := &ntlmProxy{domain: "CORP", user: "alice", password: "secret", challenge: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, handshakes: make(chan string, 4)}
+	proxy := startNTLMProxy(t, p)
+	defer proxy.Close()
+
+	d := &Dialer{
+		Timeout:     5 * time.Second,
+		ParentProxy: &url.URL{Scheme: "http", Host: proxy.Addr().String(), User: url.UserPassword(`CORP\alice`, "secret")},
+	}
+	testEcho(t, d, echo.Addr().String())
+	if method := <-p.handshakes; method != "CONNECT" {
+		t.Errorf("NTLM handshake with %s, want CONNECT", method)
+	}
+
+	d.ParentProxy.User = url.UserPassword(`CORP\alice`, "wrong")
+	if conn, err := d.Dial("tcp", echo.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("Dial with a wrong password succeeded")
+	}
+}
+
+func TestProxyTransportNTLM(t *testing.T) {
+	p := &ntlmProxy{domain: "", user: "alice", password: "secret", handshakes: make(chan string, 4)}
+	proxy := startNTLMProxy(t, p)
+	defer proxy.Close()
+
+	tr := &ProxyTransport{
+		Dialer: &Dialer{
+			Timeout:     5 * time.Second,
+			ParentProxy: &url.URL{Scheme: "http", Host: proxy.Addr().String(), User: url.UserPassword("alice", "secret")},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://www.example.com/"+strconv.Itoa(i), nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip error: %s", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := "GET http://www.example.com/" + strconv.Itoa(i); resp.StatusCode != http.StatusOK || string(b) != want {
+			t.Errorf("response = %d %q, want 200 %q", resp.StatusCode, b, want)
+		}
+	}
+	// the authorized connection is reused
+	if n := len(p.handshakes); n != 1 {
+		t.Errorf("%d NTLM handshakes, want 1", n)
+	}
+}
@@ -0,0 +1,149 @@
+package netutil
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// ProxyTransport sends plain http requests to the http parent proxy of Dialer
+// in absolute form, other requests go to Transport. Connections are kept for
+// reuse, as NTLM authorizes a connection rather than a request.
+type ProxyTransport struct {
+	Dialer               *Dialer
+	Transport            http.RoundTripper
+	MaxIdleConnsPerProxy int
+
+	mu   sync.Mutex
+	idle map[string][]*proxyConn
+	ntlm map[string]bool
+}
+
+type proxyConn struct {
+	net.Conn
+	br         *bufio.Reader
+	authorized bool
+}
+
+func (t *ProxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+	proxy := t.Dialer.parentProxy(addr)
+	if req.URL.Scheme != "http" || proxy == nil || (proxy.Scheme != "http" && proxy.Scheme != "") {
+		return t.Transport.RoundTrip(req)
+	}
+
+	if pc := t.getIdle(proxy.Host); pc != nil {
+		resp, err := t.roundTrip(pc, req, proxy)
+		if err == nil || proxyRequestHasBody(req) {
+			return resp, err
+		}
+		// the idle connection may have been closed by the proxy
+	}
+
+	conn, err := t.Dialer.dialTCP("tcp", proxy.Host, nil)
+	if err != nil {
+		return nil, err
+	}
+	return t.roundTrip(&proxyConn{Conn: conn, br: bufio.NewReader(conn)}, req, proxy)
+}
+
+func (t *ProxyTransport) roundTrip(pc *proxyConn, req *http.Request, proxy *url.URL) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	if pc.authorized {
+		if err = writeProxyRequest(pc, req, ""); err == nil {
+			resp, err = http.ReadResponse(pc.br, req)
+		}
+	} else {
+		t.mu.Lock()
+		ntlm := t.ntlm[proxy.Host] || proxyWantsNTLM(proxy)
+		t.mu.Unlock()
+		resp, pc.authorized, err = roundTripProxy(pc, pc.br, req, proxy, ntlm)
+		if err == nil {
+			if _, ok := proxyNTLMChallenge(resp); ok && resp.StatusCode == http.StatusProxyAuthRequired {
+				t.mu.Lock()
+				if t.ntlm == nil {
+					t.ntlm = make(map[string]bool)
+				}
+				t.ntlm[proxy.Host] = true
+				t.mu.Unlock()
+			}
+			if proxy.User == nil {
+				pc.authorized = true
+			}
+		}
+	}
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	resp.Body = &proxyBody{
+		ReadCloser: resp.Body,
+		t:          t,
+		key:        proxy.Host,
+		pc:         pc,
+		keepAlive:  !resp.Close && !req.Close,
+	}
+	return resp, nil
+}
+
+func (t *ProxyTransport) getIdle(key string) *proxyConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := t.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	pc := conns[len(conns)-1]
+	t.idle[key] = conns[:len(conns)-1]
+	return pc
+}
+
+func (t *ProxyTransport) putIdle(key string, pc *proxyConn) {
+	max := t.MaxIdleConnsPerProxy
+	if max == 0 {
+		max = 4
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.idle == nil {
+		t.idle = make(map[string][]*proxyConn)
+	}
+	if len(t.idle[key]) >= max {
+		pc.Close()
+		return
+	}
+	t.idle[key] = append(t.idle[key], pc)
+}
+
+// proxyBody returns the connection to the idle pool once the response body
+// is consumed.
+type proxyBody struct {
+	io.ReadCloser
+	t         *ProxyTransport
+	key       string
+	pc        *proxyConn
+	keepAlive bool
+	closed    bool
+}
+
+func (b *proxyBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	err := b.ReadCloser.Close()
+	if err == nil && b.keepAlive {
+		b.t.putIdle(b.key, b.pc)
+	} else {
+		b.pc.Close()
+	}
+	return err
+}
@@ -0,0 +1,283 @@
+package netutil
+
+import (
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The Shadowsocks AEAD protocol. Each direction starts with a random salt, the
+// key of the direction is derived from the master key and the salt with
+// HKDF-SHA1. The stream is then a sequence of chunks, the sealed 2 bytes
+// length of the payload followed by the sealed payload, the nonces count the
+// seals from zero. The client sends the target address in the socks5 format
+// first.
+
+const shadowsocksMaxPayloadSize = 0x3fff
+
+var shadowsocksMethods = map[string]struct {
+	keySize int
+	newAEAD func([]byte) (cipher.AEAD, error)
+}{
+	"chacha20-ietf-poly1305": {chacha20poly1305.KeySize, chacha20poly1305.New},
+	"aes-256-gcm":            {32, NewAESGCM},
+}
+
+// A ShadowsocksCipher is the method and the master key shared by the client
+// and the server.
+type ShadowsocksCipher struct {
+	key     []byte
+	newAEAD func([]byte) (cipher.AEAD, error)
+}
+
+// NewShadowsocksCipher returns the cipher of method, chacha20-ietf-poly1305 or
+// aes-256-gcm, with the master key derived from password.
+func NewShadowsocksCipher(method, password string) (*ShadowsocksCipher, error) {
+	m, ok := shadowsocksMethods[method]
+	if !ok {
+		return nil, fmt.Errorf("shadowsocks: unsupported method %#v", method)
+	}
+	return &ShadowsocksCipher{
+		key:     evpBytesToKey(password, m.keySize),
+		newAEAD: m.newAEAD,
+	}, nil
+}
+
+// evpBytesToKey is the OpenSSL EVP_BytesToKey with MD5, one iteration and no
+// salt, which ss-server uses for the master key.
+func evpBytesToKey(password string, keySize int) []byte {
+	var key, prev []byte
+	for len(key) < keySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
+
+func (c *ShadowsocksCipher) aead(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), key); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(key)
+}
+
+type shadowsocksConn struct {
+	net.Conn
+	cipher *ShadowsocksCipher
+
+	readMu    sync.Mutex
+	readAEAD  cipher.AEAD
+	readNonce []byte
+	readBuf   []byte
+	plain     []byte
+
+	writeMu    sync.Mutex
+	writeAEAD  cipher.AEAD
+	writeNonce []byte
+	writeBuf   []byte
+}
+
+// ShadowsocksClient returns a connection to target through the Shadowsocks
+// server connected by conn.
+func ShadowsocksClient(conn net.Conn, c *ShadowsocksCipher, target string) (net.Conn, error) {
+	addr, err := appendSocks5HostPort(nil, target)
+	if err != nil {
+		return nil, err
+	}
+	sc := &shadowsocksConn{Conn: conn, cipher: c}
+	if _, err := sc.Write(addr); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// ShadowsocksServer reads the target address sent by the Shadowsocks client
+// connected by conn, and returns the connection to relay.
+func ShadowsocksServer(conn net.Conn, c *ShadowsocksCipher) (net.Conn, string, error) {
+	sc := &shadowsocksConn{Conn: conn, cipher: c}
+	target, err := readSocks5Addr(sc)
+	if err != nil {
+		return nil, "", err
+	}
+	return sc, target, nil
+}
+
+func (c *shadowsocksConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.readAEAD == nil {
+		salt := make([]byte, len(c.cipher.key))
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.readAEAD = aead
+		c.readNonce = make([]byte, aead.NonceSize())
+		c.readBuf = make([]byte, shadowsocksMaxPayloadSize+aead.Overhead())
+	}
+	for len(c.plain) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func (c *shadowsocksConn) readChunk() error {
+	overhead := c.readAEAD.Overhead()
+	buf := c.readBuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	if _, err := c.readAEAD.Open(buf[:0], c.readNonce, buf, nil); err != nil {
+		return err
+	}
+	incNonce(c.readNonce)
+	size := int(binary.BigEndian.Uint16(buf)) & shadowsocksMaxPayloadSize
+
+	buf = c.readBuf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := c.readAEAD.Open(buf[:0], c.readNonce, buf, nil)
+	if err != nil {
+		return err
+	}
+	incNonce(c.readNonce)
+	c.plain = plain
+	return nil
+}
+
+func (c *shadowsocksConn) Write(b []byte) (n int, err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	// the salt is sent with the first chunk, there is none to send yet
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var salt []byte
+	if c.writeAEAD == nil {
+		salt = make([]byte, len(c.cipher.key))
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.writeAEAD = aead
+		c.writeNonce = make([]byte, aead.NonceSize())
+	}
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > shadowsocksMaxPayloadSize {
+			chunk = chunk[:shadowsocksMaxPayloadSize]
+		}
+		// the salt goes with the first chunk
+		buf := append(append(c.writeBuf[:0], salt...), byte(len(chunk)>>8), byte(len(chunk)))
+		buf = c.writeAEAD.Seal(buf[:len(salt)], c.writeNonce, buf[len(salt):], nil)
+		incNonce(c.writeNonce)
+		buf = c.writeAEAD.Seal(buf, c.writeNonce, chunk, nil)
+		incNonce(c.writeNonce)
+		c.writeBuf = buf[:0]
+		salt = nil
+		if _, err := c.Conn.Write(buf); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// A ShadowsocksDialer connects the targets through a Shadowsocks server.
+type ShadowsocksDialer struct {
+	// Server is the address of the Shadowsocks server.
+	Server string
+	Cipher *ShadowsocksCipher
+	// DialServer connects the server, it is net.Dial if nil.
+	DialServer func(network, addr string) (net.Conn, error)
+}
+
+func (d *ShadowsocksDialer) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("shadowsocks: unsupported network %#v", network)
+	}
+	dial := d.DialServer
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial(network, d.Server)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := ShadowsocksClient(conn, d.Cipher, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// ServeShadowsocks relays the connections of the Shadowsocks clients accepted
+// on ln to their targets, which are connected with dial, net.Dial if nil.
+func ServeShadowsocks(ln net.Listener, c *ShadowsocksCipher, dial func(network, addr string) (net.Conn, error)) error {
+	if dial == nil {
+		dial = net.Dial
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+			local, target, err := ShadowsocksServer(conn, c)
+			if err != nil {
+				glog.Warningf("ShadowsocksServer(%s) error: %s", conn.RemoteAddr(), err)
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			remote, err := dial("tcp", target)
+			if err != nil {
+				glog.Warningf("ShadowsocksServer(%s) dial %s error: %s", conn.RemoteAddr(), target, err)
+				return
+			}
+			defer remote.Close()
+			go func() {
+				io.Copy(remote, local)
+				if tc, ok := remote.(*net.TCPConn); ok {
+					tc.CloseWrite()
+				}
+			}()
+			io.Copy(local, remote)
+		}(conn)
+	}
+}
@@ -0,0 +1,121 @@
+package netutil
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestEVPBytesToKey(t *testing.T) {
+	// openssl enc -aes-256-cbc -k foobar -nosalt -P -md md5
+	want := "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf"
+	if key := hex.EncodeToString(evpBytesToKey("foobar", 32)); key != want {
+		t.Errorf("evpBytesToKey = %s, want %s", key, want)
+	}
+}
+
+// echoServer returns the address of a tcp echo server.
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestShadowsocks(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	for _, method := range []string{"chacha20-ietf-poly1305", "aes-256-gcm"} {
+		c, err := NewShadowsocksCipher(method, "secret")
+		if err != nil {
+			t.Fatalf("NewShadowsocksCipher(%#v) error: %s", method, err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen error: %s", err)
+		}
+		go ServeShadowsocks(ln, c, nil)
+
+		d := &ShadowsocksDialer{Server: ln.Addr().String(), Cipher: c}
+		conn, err := d.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: Dial error: %s", method, err)
+		}
+		// larger than a chunk
+		data := bytes.Repeat([]byte("0123456789abcdef"), 5000)
+		go conn.Write(data)
+		b := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("%s: ReadFull error: %s", method, err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("%s: echo differs", method)
+		}
+		conn.Close()
+
+		// the server drops a client with the wrong password
+		wrong, _ := NewShadowsocksCipher(method, "wrong")
+		d.Cipher = wrong
+		conn, err = d.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: Dial error: %s", method, err)
+		}
+		conn.Write([]byte("hello"))
+		if b, err := ioutil.ReadAll(conn); err == nil && len(b) > 0 {
+			t.Errorf("%s: ReadAll with the wrong password = %q", method, b)
+		}
+		conn.Close()
+		ln.Close()
+	}
+
+	if _, err := NewShadowsocksCipher("rc4-md5", "secret"); err == nil {
+		t.Errorf("NewShadowsocksCipher(\"rc4-md5\") succeeded")
+	}
+}
+
+func TestShadowsocksServerTarget(t *testing.T) {
+	c, _ := NewShadowsocksCipher("aes-256-gcm", "secret")
+	for _, target := range []string{"example.com:443", "1.2.3.4:80", "[2001:db8::1]:8080"} {
+		c1, c2 := net.Pipe()
+		go ShadowsocksClient(c1, c, target)
+		_, got, err := ShadowsocksServer(c2, c)
+		if err != nil || got != target {
+			t.Errorf("ShadowsocksServer target = %#v, %v, want %#v", got, err, target)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestShadowsocksEmptyWrite(t *testing.T) {
+	c, _ := NewShadowsocksCipher("aes-256-gcm", "secret")
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		sc := &shadowsocksConn{Conn: c1, cipher: c}
+		sc.Write(nil)
+		sc.Write([]byte("hello"))
+	}()
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(&shadowsocksConn{Conn: c2, cipher: c}, b); err != nil || string(b) != "hello" {
+		t.Errorf("Read = %q, %v, want %q", b, err, "hello")
+	}
+}
@@ -0,0 +1,333 @@
+package netutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version byte = 0x05
+
+	socks5AuthNone     byte = 0x00
+	socks5AuthPassword byte = 0x02
+	socks5AuthNoAccept byte = 0xff
+
+	socks5CmdConnect      byte = 0x01
+	socks5CmdBind         byte = 0x02
+	socks5CmdUDPAssociate byte = 0x03
+
+	socks5AtypIPv4   byte = 0x01
+	socks5AtypDomain byte = 0x03
+	socks5AtypIPv6   byte = 0x04
+
+	socks5RepSucceeded           byte = 0x00
+	socks5RepGeneralFailure      byte = 0x01
+	socks5RepNotAllowed          byte = 0x02
+	socks5RepHostUnreachable     byte = 0x04
+	socks5RepConnectionRefused   byte = 0x05
+	socks5RepCommandNotSupported byte = 0x07
+	socks5RepAtypNotSupported    byte = 0x08
+)
+
+type SocksServer struct {
+	// Auth checks the username and password of RFC 1929 authentication,
+	// no authentication is required if Auth is nil.
+	Auth func(username, password string) bool
+	// Timeout limits the time spent on sniffing and the handshake.
+	Timeout time.Duration
+	// Dial opens the outbound sockets of UDP ASSOCIATE, net.Dial is used
+	// if Dial is nil.
+	Dial func(network, addr string) (net.Conn, error)
+	// UDPTimeout closes idle UDP ASSOCIATE mappings.
+	UDPTimeout time.Duration
+	// MaxUDPConns caps the outbound sockets of an UDP ASSOCIATE, 256 if 0,
+	// the datagrams to more destinations are dropped.
+	MaxUDPConns int
+	// NoUDP answers UDP ASSOCIATE by "command not supported", for a Dial
+	// which cannot carry udp, as with a parent proxy.
+	NoUDP bool
+}
+
+// sniffConn replays the bytes read while sniffing the protocol.
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Sniff peeks the first byte of c. Non-SOCKS5 connections are returned as is,
+// SOCKS5 connections are handshaked and returned as a net.Conn which reads
+// an equivalent HTTP CONNECT request and translates the HTTP response back
+// to a SOCKS5 reply. UDP ASSOCIATE is served by Sniff itself, which then
+// returns a nil net.Conn once the association is over.
+func (s *SocksServer) Sniff(c net.Conn) (net.Conn, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(c)
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != socks5Version {
+		return &sniffConn{c, br}, nil
+	}
+	return s.handshake(&sniffConn{c, br})
+}
+
+func readSocks5Addr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4:
+		b := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = net.IP(b).String()
+	case socks5AtypIPv6:
+		b := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = net.IP(b).String()
+	case socks5AtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, int(n[0]))
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", fmt.Errorf("socks: unsupported address type %#x", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func appendSocks5Addr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else if ip != nil {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, ip.To16()...)
+	} else {
+		b = append(b, socks5AtypIPv4, 0, 0, 0, 0)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// appendSocks5HostPort appends addr, host names are kept as is so that they
+// are resolved by the other end.
+func appendSocks5HostPort(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("netutil: host name %#v too long", host)
+		}
+		b = append(b, socks5AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+func writeSocks5Reply(w io.Writer, rep byte, addr net.Addr) error {
+	_, err := w.Write(appendSocks5Addr([]byte{socks5Version, rep, 0x00}, addr))
+	return err
+}
+
+func (s *SocksServer) handshake(c net.Conn) (net.Conn, error) {
+	// greeting
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, int(hdr[1]))
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return nil, err
+	}
+	method := socks5AuthNone
+	if s.Auth != nil {
+		method = socks5AuthPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		c.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return nil, errors.New("socks: no acceptable authentication method")
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+
+	// RFC 1929 username/password authentication
+	var username, password string
+	if method == socks5AuthPassword {
+		var ver, n [1]byte
+		if _, err := io.ReadFull(c, ver[:]); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return nil, err
+		}
+		b := make([]byte, int(n[0]))
+		if _, err := io.ReadFull(c, b); err != nil {
+			return nil, err
+		}
+		username = string(b)
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return nil, err
+		}
+		b = make([]byte, int(n[0]))
+		if _, err := io.ReadFull(c, b); err != nil {
+			return nil, err
+		}
+		password = string(b)
+		if !s.Auth(username, password) {
+			c.Write([]byte{0x01, 0x01})
+			return nil, fmt.Errorf("socks: user %#v authentication failed", username)
+		}
+		if _, err := c.Write([]byte{0x01, 0x00}); err != nil {
+			return nil, err
+		}
+	}
+
+	// request
+	var req [3]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return nil, err
+	}
+	if req[0] != socks5Version {
+		return nil, fmt.Errorf("socks: unsupported version %#x", req[0])
+	}
+	addr, err := readSocks5Addr(c)
+	if err != nil {
+		writeSocks5Reply(c, socks5RepAtypNotSupported, nil)
+		return nil, err
+	}
+
+	switch req[1] {
+	case socks5CmdConnect:
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+		if method == socks5AuthPassword {
+			fmt.Fprintf(&b, "Proxy-Authorization: Basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+		}
+		b.WriteString("\r\n")
+		return &socksConn{
+			Conn: c,
+			r:    io.MultiReader(&b, c),
+		}, nil
+	case socks5CmdUDPAssociate:
+		return nil, s.associate(c)
+	default:
+		writeSocks5Reply(c, socks5RepCommandNotSupported, nil)
+		return nil, fmt.Errorf("socks: unsupported command %#x", req[1])
+	}
+}
+
+// socksConn carries a SOCKS5 CONNECT as a HTTP CONNECT request. The status of
+// the HTTP response is turned into the SOCKS5 reply, the rest of the
+// connection is passed through.
+type socksConn struct {
+	net.Conn
+	r       io.Reader
+	header  []byte
+	replied bool
+	failed  bool
+}
+
+func (c *socksConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *socksConn) Write(b []byte) (int, error) {
+	if c.replied {
+		return c.Conn.Write(b)
+	}
+	if c.failed {
+		return len(b), nil
+	}
+
+	c.header = append(c.header, b...)
+	i := bytes.Index(c.header, []byte("\r\n\r\n"))
+	if i < 0 {
+		return len(b), nil
+	}
+
+	rep := socks5RepGeneralFailure
+	line := c.header[:bytes.IndexByte(c.header, '\n')]
+	if fields := bytes.Fields(line); len(fields) >= 2 {
+		switch string(fields[1]) {
+		case "200":
+			rep = socks5RepSucceeded
+		case "403", "407":
+			rep = socks5RepNotAllowed
+		case "502":
+			rep = socks5RepConnectionRefused
+		case "504":
+			rep = socks5RepHostUnreachable
+		}
+	}
+	if err := writeSocks5Reply(c.Conn, rep, c.Conn.LocalAddr()); err != nil {
+		return 0, err
+	}
+	if rep != socks5RepSucceeded {
+		c.failed = true
+		c.Conn.Close()
+		return len(b), nil
+	}
+
+	c.replied = true
+	if rest := c.header[i+4:]; len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	c.header = nil
+	return len(b), nil
+}
@@ -0,0 +1,236 @@
+package netutil
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func socks5Connect(t *testing.T, c net.Conn, username, password string) []byte {
+	if username == "" {
+		c.Write([]byte{0x05, 0x01, 0x00})
+	} else {
+		c.Write([]byte{0x05, 0x01, 0x02})
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		t.Fatalf("read method error: %s", err)
+	}
+	if username != "" {
+		msg := []byte{0x01, byte(len(username))}
+		msg = append(msg, username...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		c.Write(msg)
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			t.Fatalf("read auth status error: %s", err)
+		}
+		if b[1] != 0x00 {
+			return nil
+		}
+	}
+	msg := []byte{0x05, 0x01, 0x00, 0x03, byte(len("www.example.com"))}
+	msg = append(msg, "www.example.com"...)
+	msg = append(msg, 0x01, 0xbb)
+	c.Write(msg)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatalf("read reply error: %s", err)
+	}
+	return reply
+}
+
+func TestSocksConnect(t *testing.T) {
+	s := &SocksServer{
+		Auth: func(username, password string) bool {
+			return username == "alice" && password == "secret"
+		},
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		c, err := s.Sniff(server)
+		if err != nil {
+			server.Close()
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			t.Errorf("http.ReadRequest error: %s", err)
+			c.Close()
+			return
+		}
+		if req.Method != "CONNECT" || req.Host != "www.example.com:443" {
+			t.Errorf("request = %s %s, want CONNECT www.example.com:443", req.Method, req.Host)
+		}
+		if req.Header.Get("Proxy-Authorization") != "Basic YWxpY2U6c2VjcmV0" {
+			t.Errorf("Proxy-Authorization = %#v", req.Header.Get("Proxy-Authorization"))
+		}
+		io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\nhello")
+		c.Close()
+	}()
+
+	reply := socks5Connect(t, client, "alice", "secret")
+	if reply == nil || reply[1] != 0x00 {
+		t.Fatalf("reply = %v, want success", reply)
+	}
+	b, _ := ioutil.ReadAll(client)
+	if !bytes.Equal(b, []byte("hello")) {
+		t.Errorf("data = %q, want %q", b, "hello")
+	}
+}
+
+func TestSocksConnectRefused(t *testing.T) {
+	s := &SocksServer{}
+
+	client, server := net.Pipe()
+	go func() {
+		c, err := s.Sniff(server)
+		if err != nil {
+			server.Close()
+			return
+		}
+		http.ReadRequest(bufio.NewReader(c))
+		io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 5\r\n\r\nerror")
+		c.Close()
+	}()
+
+	reply := socks5Connect(t, client, "", "")
+	if reply[1] != socks5RepConnectionRefused {
+		t.Errorf("reply = %v, want connection refused", reply)
+	}
+}
+
+func TestSocksSniffHTTP(t *testing.T) {
+	s := &SocksServer{}
+
+	client, server := net.Pipe()
+	go func() {
+		io.WriteString(client, "GET http://www.example.com/ HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	}()
+
+	c, err := s.Sniff(server)
+	if err != nil {
+		t.Fatalf("Sniff error: %s", err)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		t.Fatalf("http.ReadRequest error: %s", err)
+	}
+	if req.Method != "GET" || req.URL.String() != "http://www.example.com/" {
+		t.Errorf("request = %s %s", req.Method, req.URL)
+	}
+}
+
+func listenUDPEcho(t *testing.T) net.PacketConn {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket error: %s", err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(bytes.ToUpper(buf[:n]), addr)
+		}
+	}()
+	return echo
+}
+
+func TestSocksUDPAssociate(t *testing.T) {
+	echo := listenUDPEcho(t)
+	defer echo.Close()
+	echo2 := listenUDPEcho(t)
+	defer echo2.Close()
+
+	s := &SocksServer{UDPTimeout: 200 * time.Millisecond, MaxUDPConns: 1}
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.Sniff(server)
+
+	client.Write([]byte{0x05, 0x01, 0x00})
+	var b [4]byte
+	io.ReadFull(client, b[:2])
+	client.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if _, err := io.ReadFull(client, b[:]); err != nil || b[1] != 0x00 {
+		t.Fatalf("UDP ASSOCIATE reply = %v, %v", b, err)
+	}
+	bnd, err := readSocks5Addr(io.MultiReader(bytes.NewReader(b[3:]), client))
+	if err != nil {
+		t.Fatalf("readSocks5Addr error: %s", err)
+	}
+	_, port, _ := net.SplitHostPort(bnd)
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("net.Dial error: %s", err)
+	}
+	defer conn.Close()
+
+	packet := appendSocks5Addr([]byte{0x00, 0x00, 0x00}, echo.LocalAddr())
+	conn.Write(append(packet, "hello"...))
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("conn.Read error: %s", err)
+	}
+	addr, payload, err := parseSocks5UDPHeader(buf[:n])
+	if err != nil {
+		t.Fatalf("parseSocks5UDPHeader error: %s", err)
+	}
+	if addr != echo.LocalAddr().String() || string(payload) != "HELLO" {
+		t.Errorf("reply = %s %q, want %s %q", addr, payload, echo.LocalAddr(), "HELLO")
+	}
+
+	// the nat table is full until the first mapping is idle
+	packet = appendSocks5Addr([]byte{0x00, 0x00, 0x00}, echo2.LocalAddr())
+	conn.Write(append(packet, "world"...))
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(buf); err == nil {
+		t.Errorf("packet relayed beyond MaxUDPConns")
+	}
+	time.Sleep(300 * time.Millisecond)
+	conn.Write(append(packet, "world"...))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err = conn.Read(buf)
+	if err != nil {
+		t.Fatalf("conn.Read error: %s", err)
+	}
+	if addr, payload, _ := parseSocks5UDPHeader(buf[:n]); addr != echo2.LocalAddr().String() || string(payload) != "WORLD" {
+		t.Errorf("reply = %s %q, want %s %q", addr, payload, echo2.LocalAddr(), "WORLD")
+	}
+}
+
+func TestSocksUDPAssociateNoUDP(t *testing.T) {
+	s := &SocksServer{NoUDP: true}
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.Sniff(server)
+
+	client.Write([]byte{0x05, 0x01, 0x00})
+	var b [4]byte
+	io.ReadFull(client, b[:2])
+	client.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if _, err := io.ReadFull(client, b[:]); err != nil || b[1] != socks5RepCommandNotSupported {
+		t.Errorf("UDP ASSOCIATE reply = %v, %v, want command not supported", b, err)
+	}
+}
+
+func TestDialerUDPParentProxy(t *testing.T) {
+	d := &Dialer{ParentProxy: &url.URL{Scheme: "http", Host: "127.0.0.1:8087"}}
+	if conn, err := d.Dial("udp", "127.0.0.1:53"); err == nil {
+		conn.Close()
+		t.Errorf("udp dialed around the parent proxy")
+	}
+}
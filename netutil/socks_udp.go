@@ -0,0 +1,212 @@
+package netutil
+
+import (
+	"bytes"
+	"errors"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpAssociation relays the datagrams of one SOCKS5 UDP ASSOCIATE. Each
+// destination gets its own outbound socket in the nat table, at most max of
+// them, which is dropped after being idle for timeout. The sockets are
+// dialed directly, there is no udp path through the fetchservers.
+type udpAssociation struct {
+	ln       net.PacketConn
+	clientIP net.IP
+	dial     func(network, addr string) (net.Conn, error)
+	timeout  time.Duration
+	max      int
+	mu       sync.Mutex
+	client   net.Addr
+	nat      map[string]*udpMapping
+}
+
+// udpMapping is an outbound socket of an udpAssociation, last is the time of
+// the last datagram in either direction, guarded by the association mu.
+type udpMapping struct {
+	conn net.Conn
+	last time.Time
+}
+
+func (s *SocksServer) associate(c net.Conn) error {
+	if s.NoUDP {
+		writeSocks5Reply(c, socks5RepCommandNotSupported, nil)
+		return errors.New("socks: udp associate not supported")
+	}
+	c.SetReadDeadline(time.Time{})
+
+	host, _, err := net.SplitHostPort(c.LocalAddr().String())
+	if err != nil {
+		host = ""
+	}
+	ln, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		writeSocks5Reply(c, socks5RepGeneralFailure, nil)
+		return err
+	}
+	defer ln.Close()
+
+	if err := writeSocks5Reply(c, socks5RepSucceeded, ln.LocalAddr()); err != nil {
+		return err
+	}
+
+	a := &udpAssociation{
+		ln:      ln,
+		dial:    s.Dial,
+		timeout: s.UDPTimeout,
+		max:     s.MaxUDPConns,
+		nat:     make(map[string]*udpMapping),
+	}
+	if a.dial == nil {
+		a.dial = net.Dial
+	}
+	if a.timeout == 0 {
+		a.timeout = 60 * time.Second
+	}
+	if a.max == 0 {
+		a.max = 256
+	}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		a.clientIP = addr.IP
+	}
+
+	// the association lives as long as the control connection
+	go func() {
+		io.Copy(ioutil.Discard, c)
+		ln.Close()
+	}()
+	defer c.Close()
+
+	return a.serve()
+}
+
+func parseSocks5UDPHeader(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("socks: short udp packet")
+	}
+	if b[2] != 0x00 {
+		return "", nil, errors.New("socks: udp fragmentation not supported")
+	}
+	r := bytes.NewReader(b[3:])
+	addr, err := readSocks5Addr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, b[len(b)-r.Len():], nil
+}
+
+func (a *udpAssociation) serve() error {
+	defer func() {
+		a.mu.Lock()
+		for addr, m := range a.nat {
+			m.conn.Close()
+			delete(a.nat, addr)
+		}
+		a.mu.Unlock()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := a.ln.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		if udpAddr, ok := from.(*net.UDPAddr); ok && a.clientIP != nil {
+			if !udpAddr.IP.Equal(a.clientIP) && !(udpAddr.IP.IsLoopback() && a.clientIP.IsLoopback()) {
+				continue
+			}
+		}
+		addr, payload, err := parseSocks5UDPHeader(buf[:n])
+		if err != nil {
+			glog.V(2).Infof("socks: drop udp packet from %s: %v", from, err)
+			continue
+		}
+
+		// a mapping seen here is not removed by relay before the write, as
+		// it has just been used
+		a.mu.Lock()
+		a.client = from
+		m, ok := a.nat[addr]
+		if ok {
+			m.last = time.Now()
+		}
+		full := len(a.nat) >= a.max
+		a.mu.Unlock()
+		if !ok {
+			if full {
+				glog.V(2).Infof("socks: drop udp packet to %s: %d mappings", addr, a.max)
+				continue
+			}
+			conn, err := a.dial("udp", addr)
+			if err != nil {
+				glog.V(2).Infof("socks: dial udp %s error: %v", addr, err)
+				continue
+			}
+			m = &udpMapping{conn: conn, last: time.Now()}
+			a.mu.Lock()
+			a.nat[addr] = m
+			a.mu.Unlock()
+			go a.relay(addr, m)
+		}
+		m.conn.Write(payload)
+	}
+}
+
+// expired reports whether m has been idle for the timeout, and removes it
+// from the nat table if so.
+func (a *udpAssociation) expired(addr string, m *udpMapping) (bool, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	deadline := m.last.Add(a.timeout)
+	if time.Now().Before(deadline) {
+		return false, deadline
+	}
+	if a.nat[addr] == m {
+		delete(a.nat, addr)
+	}
+	return true, deadline
+}
+
+// relay sends the replies of m back to the client until m is idle for the
+// timeout.
+func (a *udpAssociation) relay(addr string, m *udpMapping) {
+	conn := m.conn
+	defer conn.Close()
+
+	buf := make([]byte, 64*1024)
+	for {
+		expired, deadline := a.expired(addr, m)
+		if expired {
+			return
+		}
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			a.mu.Lock()
+			if a.nat[addr] == m {
+				delete(a.nat, addr)
+			}
+			a.mu.Unlock()
+			return
+		}
+
+		b := appendSocks5Addr([]byte{0x00, 0x00, 0x00}, conn.RemoteAddr())
+		b = append(b, buf[:n]...)
+
+		a.mu.Lock()
+		m.last = time.Now()
+		client := a.client
+		a.mu.Unlock()
+		if _, err := a.ln.WriteTo(b, client); err != nil {
+			return
+		}
+	}
+}